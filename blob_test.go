@@ -0,0 +1,59 @@
+package spider
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/components/processor"
+	"github.com/xgo11/spider/core"
+)
+
+func TestProcessorDeletesBlob(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "blobs")
+	defer os.RemoveAll(dir)
+	defer core.SetBlobStore(core.GetBlobStore())
+	core.SetBlobStore(core.NewFileBlobStore(dir))
+
+	read := make(chan string, 1)
+	builder := newProject("body_test")
+	builder.AddCallback(core.ProcessCallback{
+		Name: "index",
+		Callback: func(task *core.Task, resp *core.Response) ([]*core.Task, *core.Result) {
+			body, _ := resp.Body()
+			content, _ := ioutil.ReadAll(body)
+			_ = body.Close()
+			read <- string(content)
+			return nil, nil
+		},
+	})
+	builder.RegisterMe()
+
+	ref, _, _ := core.GetBlobStore().Put(strings.NewReader("streamed"))
+	task := UrlTask("http://localhost/blob", map[string]interface{}{"callback": "index"})
+	task.Project = builder.GetName()
+	f2pQ := NewMemoryQueue("f2p", 0)
+	putFetched(t, f2pQ, task, &core.Response{StatusCode: 200, Blob: ref})
+	p := processor.NewProcessor(NewMemoryQueue("new", 0), f2pQ, NewMemoryQueue("p2r", 0), nil)
+	defer start(p)()
+
+	select {
+	case content := <-read:
+		if content != "streamed" {
+			t.Fatalf("callback should read the blob, got %q", content)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("callback not called")
+	}
+	deleted := waitFor(3*time.Second, func() bool {
+		files, _ := ioutil.ReadDir(dir)
+		return len(files) == 0
+	})
+	if !deleted {
+		t.Fatalf("the blob should be deleted once processed")
+	}
+}
@@ -0,0 +1,142 @@
+package fetcher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+const sniffSize = 512 // bytes of a body to tell its content type, see http.DetectContentType
+
+type bodyTooLargeError struct {
+	maxSize int64
+}
+
+func (e *bodyTooLargeError) Error() string {
+	return fmt.Sprintf("body over %d bytes", e.maxSize)
+}
+
+// isText tells whether a body of contentType is text, its head is sniffed when there is no contentType
+func isText(contentType string, head []byte) bool {
+	if contentType == "" {
+		contentType = http.DetectContentType(head)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	for _, s := range []string{"json", "xml", "javascript", "html", "x-www-form-urlencoded"} {
+		if strings.Contains(mediaType, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody read the body of httpResp by policy, into resp.Content, or to the blob store when it is
+// too long or not text for the message
+func readBody(resp *core.Response, httpResp *http.Response, policy core.BodyPolicy) error {
+	if policy.MaxSize > 0 && httpResp.ContentLength > policy.MaxSize && !policy.Truncate {
+		return &bodyTooLargeError{maxSize: policy.MaxSize}
+	}
+	var body io.Reader = httpResp.Body
+	if policy.MaxSize > 0 {
+		body = io.LimitReader(body, policy.MaxSize+1) // the byte over tells a longer body
+	}
+
+	// read as much as it takes to tell whether to stream
+	head := &bytes.Buffer{}
+	var err error
+	switch {
+	case policy.StreamSize > 0:
+		_, err = io.CopyN(head, body, policy.StreamSize+1)
+	case policy.StreamBinary:
+		_, err = io.CopyN(head, body, sniffSize)
+	default:
+		_, err = head.ReadFrom(body)
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	stream := (policy.StreamSize > 0 && int64(head.Len()) > policy.StreamSize) ||
+		(policy.StreamBinary && !isText(httpResp.Header.Get("Content-Type"), head.Bytes()))
+
+	if !stream {
+		if _, err = head.ReadFrom(body); err != nil {
+			return err
+		}
+		content := head.Bytes()
+		if policy.MaxSize > 0 && int64(len(content)) > policy.MaxSize {
+			if !policy.Truncate {
+				return &bodyTooLargeError{maxSize: policy.MaxSize}
+			}
+			content, resp.Truncated = content[:policy.MaxSize], true
+		}
+		resp.Content = content
+		resp.ContentLength = len(content)
+		return nil
+	}
+
+	rest := io.MultiReader(head, body)
+	var toPut io.Reader = rest
+	if policy.MaxSize > 0 {
+		toPut = io.LimitReader(rest, policy.MaxSize)
+	}
+	store := core.GetBlobStore()
+	ref, size, err := store.Put(toPut)
+	if err != nil {
+		return err
+	}
+	if n, _ := rest.Read(make([]byte, 1)); n > 0 {
+		if !policy.Truncate {
+			_ = store.Delete(ref)
+			return &bodyTooLargeError{maxSize: policy.MaxSize}
+		}
+		resp.Truncated = true
+	}
+	resp.Blob = ref
+	resp.ContentLength = int(size)
+	return nil
+}
+
+// deleteBlob remove the body of resp from the blob store, for a response which is not handed to the processor
+func deleteBlob(resp *core.Response) {
+	if resp.Blob == "" {
+		return
+	}
+	if err := core.GetBlobStore().Delete(resp.Blob); err != nil {
+		logger.WithError(err).WithField("blob", resp.Blob).WithField("op", "deleteBlob").Error("fail")
+	}
+	resp.Blob = ""
+}
+
+// inlineBlob move the body of resp from the blob store into its Content, for the callers not sharing the store,
+// the blob is deleted even when it can not be read
+func inlineBlob(resp *core.Response) error {
+	if resp.Blob == "" {
+		return nil
+	}
+	defer deleteBlob(resp)
+	body, err := resp.Body()
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadAll(body)
+	_ = body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Content = content
+	return nil
+}
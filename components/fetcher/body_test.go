@@ -0,0 +1,141 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestFetcherBodyPolicy(t *testing.T) {
+	page := strings.Repeat("<p>spider</p>", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chunked": // no Content-Length
+			_, _ = w.Write([]byte(page[:10]))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte(page[10:]))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte("\x89PNG\r\n\x1a\n"))
+		default:
+			_, _ = w.Write([]byte(page))
+		}
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "blobs")
+	defer os.RemoveAll(dir)
+	defer core.SetBlobStore(core.GetBlobStore())
+	core.SetBlobStore(core.NewFileBlobStore(dir))
+
+	fetch := func(path string, policy core.BodyPolicy) *core.Response {
+		task := newTask(server.URL+path, nil)
+		task.Fetch.Body = &policy
+		return fetchTask(task)
+	}
+	body := func(resp *core.Response) string {
+		rc, err := resp.Body()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		b, _ := ioutil.ReadAll(rc)
+		return string(b)
+	}
+
+	if resp := fetch("/", core.DefaultBodyPolicy); resp.StatusCode != 200 || string(resp.Content) != page || resp.Blob != "" {
+		t.Fatalf("should keep the content, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+	for _, path := range []string{"/", "/chunked"} {
+		if resp := fetch(path, core.BodyPolicy{MaxSize: 100}); resp.StatusCode != core.StatusBodyTooLarge || resp.Content != nil {
+			t.Fatalf("%v should be too large, got %v %v", path, resp.StatusCode, resp.ErrMessage)
+		}
+		resp := fetch(path, core.BodyPolicy{MaxSize: 100, Truncate: true})
+		if resp.StatusCode != 200 || string(resp.Content) != page[:100] || !resp.Truncated {
+			t.Fatalf("%v should be truncated, got %v %v %v", path, resp.StatusCode, resp.ContentLength, resp.Truncated)
+		}
+	}
+
+	resp := fetch("/chunked", core.BodyPolicy{StreamSize: 100})
+	if resp.StatusCode != 200 || resp.Content != nil || !strings.HasPrefix(resp.Blob, "file://") || body(resp) != page {
+		t.Fatalf("should stream a long body, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Blob)
+	}
+	if resp.ContentLength != len(page) {
+		t.Fatalf("should tell the length of the blob, got %v", resp.ContentLength)
+	}
+	if resp = fetch("/", core.BodyPolicy{StreamSize: 10000, StreamBinary: true}); resp.Blob != "" || body(resp) != page {
+		t.Fatalf("should keep a short text, got %q", resp.Blob)
+	}
+	if resp = fetch("/image", core.BodyPolicy{StreamBinary: true}); resp.Blob == "" || body(resp) != "\x89PNG\r\n\x1a\n" {
+		t.Fatalf("should stream a binary body, got %v %q", resp.ErrMessage, resp.Blob)
+	}
+
+	resp = fetch("/chunked", core.BodyPolicy{MaxSize: 500, StreamSize: 100, Truncate: true})
+	if resp.StatusCode != 200 || !resp.Truncated || body(resp) != page[:500] {
+		t.Fatalf("should truncate a streamed body, got %v %v", resp.StatusCode, resp.Truncated)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if resp = fetch("/chunked", core.BodyPolicy{MaxSize: 500, StreamSize: 100}); resp.StatusCode != core.StatusBodyTooLarge {
+		t.Fatalf("should fail a streamed body too large, got %v", resp.StatusCode)
+	}
+	if after, _ := ioutil.ReadDir(dir); len(after) != len(files) {
+		t.Fatalf("should remove the blob of a body too large, %v files before, %v after", len(files), len(after))
+	}
+
+	if _, err := (&core.Response{Blob: "file:///etc/passwd"}).Body(); err == nil {
+		t.Fatalf("should not open a file out of the store")
+	}
+}
+
+// brokenQueue fails every Put
+type brokenQueue struct {
+	sliceQueue
+}
+
+func (q *brokenQueue) Put(message ...string) error {
+	return errors.New("broken")
+}
+
+func TestFetcherDeletesBlobsNotHandedOver(t *testing.T) {
+	page := strings.Repeat("<p>spider</p>", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "blobs")
+	defer os.RemoveAll(dir)
+	defer core.SetBlobStore(core.GetBlobStore())
+	core.SetBlobStore(core.NewFileBlobStore(dir))
+
+	task := newTask(server.URL, nil)
+	task.Fetch.Body = &core.BodyPolicy{StreamSize: 100}
+	task.Fetch.Retries = -1
+	body, _ := json.Marshal(task)
+
+	rec := httptest.NewRecorder()
+	newTestFetcher().HttpServe()(rec, httptest.NewRequest(http.MethodPost, "/fetch", strings.NewReader(string(body))))
+	out := core.Fetch2ProcessMessage{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || out.Response == nil || string(out.Response.Content) != page {
+		t.Fatalf("the answer should carry the body, got %v %v", err, rec.Body.String())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 || out.Response.Blob != "" {
+		t.Fatalf("the blob of an answer should be deleted, %d left", len(files))
+	}
+
+	s2fQ := &sliceQueue{name: "s2f"}
+	hf := NewFetcher(s2fQ, &brokenQueue{sliceQueue{name: "f2p"}}, nil).(*httpFetcher)
+	hf.runOneTask(string(body), task)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 || s2fQ.Size() != 1 {
+		t.Fatalf("the blob of a task given back should be deleted, %d left", len(files))
+	}
+}
@@ -1,14 +1,11 @@
 package fetcher
 
 import (
-	"compress/flate"
-	"compress/gzip"
-	"compress/zlib"
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -23,24 +20,60 @@ import (
 
 const (
 	defaultConnectTimeout = 30 * time.Second
+	defaultTLSTimeout     = 10 * time.Second
 	defaultReadTimeout    = 120 * time.Second
-	defaultRetryInterval  = 3 * time.Second
-	defaultRetryTimes     = 3
 	defaultMaxRedirects   = 10
+	maxDrainSize          = 64 << 10 // of a response given up for a retry
 )
 
-type httpClient struct{}
+// redirectError is the error of a fetch stopped by the redirect policy of its task
+type redirectError struct {
+	msg string
+}
+
+func (e *redirectError) Error() string {
+	return e.msg
+}
+
+// isRedirectError tells whether err is of a fetch stopped by the redirect policy, the client wraps it in url.Error
+func isRedirectError(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	_, ok := err.(*redirectError)
+	return ok
+}
+
+type httpClient struct {
+	transports *transportCache
+	proxies    core.IProxyProvider // for the tasks without a Fetch.Proxy
+	done       <-chan struct{}     // closed on shutdown, the waits between the retries end at it
+}
 
 type clientParams struct {
+	task           *core.Task
 	url            *url.URL
 	proxy          *url.URL
+	pooled         bool   // the proxy is taken from the provider for every attempt
+	pooledProxy    string // as the provider gave it
+	proxyAuth      string // Proxy-Authorization of the task, for a http proxy
+	tls            core.TLSConfig
+	tlsConfig      *tls.Config // loaded of tls
+	bodyPolicy     core.BodyPolicy
 	header         http.Header
 	method         string
 	body           io.Reader
 	connectTimeout time.Duration
-	readTimeout    time.Duration
-	retryInterval  time.Duration
-	retryTimes     int
+	tlsTimeout     time.Duration
+	headerTimeout  time.Duration
+	readTimeout    time.Duration // of the whole fetch
+	deadline       time.Time     // of the whole fetch, the retries and the waits before them included
+	timer          *fetchTimer
+	trace          *fetchTrace // of the last try
+	stopAtRedirect bool
+	redirects      []core.RedirectHop // of the last try
+	retry          core.RetryPolicy
+	attempts       []core.FetchAttempt
 	redirectTimes  int
 	client         *http.Client
 }
@@ -48,7 +81,7 @@ type clientParams struct {
 func (hClient *httpClient) Do(task *core.Task) (resp *core.Response) {
 	var params *clientParams
 	var httpResp *http.Response
-	var err error
+	var err, decodeErr error
 
 	resp = &core.Response{Url: task.Url}
 	startTime := datetime.Now()
@@ -56,7 +89,7 @@ func (hClient *httpClient) Do(task *core.Task) (resp *core.Response) {
 	if params, err = hClient.buildHttpParams(task); err == nil {
 		params.client = hClient.buildHttpClient(params)
 		if httpResp, err = hClient.doRequest(params); err == nil {
-			hClient.deCompressRespBody(httpResp)
+			decodeErr = decodeBody(httpResp)
 		}
 	}
 
@@ -84,20 +117,28 @@ func (hClient *httpClient) Do(task *core.Task) (resp *core.Response) {
 			resp.Cookies[item.Name] = item.Value
 		}
 
-		var ctx []byte
-		if ctx, err = ioutil.ReadAll(httpResp.Body); err == nil {
-			_ = httpResp.Body.Close()
-			resp.Content = ctx
-			resp.ContentLength = len(resp.Content)
+		err = readBody(resp, httpResp, params.bodyPolicy)
+		_ = httpResp.Body.Close()
+	}
+	if params != nil {
+		if params.trace != nil {
+			var proto string
+			if httpResp != nil {
+				proto = httpResp.Proto
+			}
+			resp.Timing = params.trace.result(proto, len(params.attempts))
+		}
+		resp.Attempts = params.attempts
+		resp.Redirects = params.redirects
+		resp.Proxy = redactProxy(params.proxy)
+		if params.timer != nil {
+			params.timer.stop()
 		}
 	}
 	if err != nil {
-		if params == nil { // before request error
-			resp.StatusCode = 99
-		} else { // http request error
-			resp.StatusCode = 599
-		}
-		resp.ErrMessage = err.Error()
+		resp.StatusCode, resp.ErrMessage = fetchError(params, err)
+	} else if decodeErr != nil { // the content is left encoded
+		resp.StatusCode, resp.ErrMessage = core.StatusDecodeError, decodeErr.Error()
 	}
 	endTime := datetime.Now()
 	resp.TimeMS = int(endTime.Sub(startTime).Round(time.Millisecond) / time.Millisecond)
@@ -108,13 +149,83 @@ func (hClient *httpClient) Do(task *core.Task) (resp *core.Response) {
 	return
 }
 
+// parseProxy parse a proxy url, http:// is taken when there is no scheme
+func parseProxy(proxy string) (*url.URL, error) {
+	if strings.Index(proxy, "://") < 0 {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err == nil && !supportedProxy(u) {
+		err = fmt.Errorf("unsupported proxy scheme %v", u.Scheme)
+	}
+	return u, err
+}
+
+// redactProxy hides the password of a proxy, to be logged
+func redactProxy(proxy *url.URL) string {
+	if proxy == nil {
+		return ""
+	}
+	if _, ok := proxy.User.Password(); ok {
+		u := *proxy
+		u.User = url.UserPassword(proxy.User.Username(), "xxxxx")
+		return u.String()
+	}
+	return proxy.String()
+}
+
+// pickProxy take a proxy from the provider for the next attempt, and switch the client to its transport
+func (hClient *httpClient) pickProxy(param *clientParams) {
+	param.proxy = nil
+	param.pooledProxy = hClient.proxies.Get(param.task)
+	if param.pooledProxy != "" {
+		var err error
+		if param.proxy, err = parseProxy(param.pooledProxy); err != nil {
+			hClient.proxies.Report(param.pooledProxy, false)
+			param.proxy, param.pooledProxy = nil, ""
+		}
+	}
+	param.client.Transport = hClient.transports.get(param)
+}
+
+// proxyOK tells whether an attempt went well as far as its proxy is concerned,
+// the status an origin answers, a 403 or 429 included, says nothing of the proxy
+func proxyOK(resp *http.Response, err error) bool {
+	if err != nil {
+		return isRedirectError(err) // the redirect policy of the task stopped it, not the proxy
+	}
+	return resp.StatusCode != http.StatusProxyAuthRequired
+}
+
+// fetchError tells the Response.StatusCode and ErrMessage of a failed fetch
+func fetchError(params *clientParams, err error) (int, string) {
+	if params == nil { // before request error
+		return core.StatusInvalidTask, err.Error()
+	}
+	if _, ok := err.(*bodyTooLargeError); ok {
+		return core.StatusBodyTooLarge, err.Error()
+	}
+	if params.timer != nil {
+		if expired := params.timer.expiredTimeout(); expired != "" {
+			return timeoutStatus[expired], fmt.Sprintf("%s timeout: %v", expired, err)
+		}
+	}
+	if isTLSError(err) {
+		return core.StatusTLSError, fmt.Sprintf("tls handshake failed: %v", err)
+	}
+	if isRedirectError(err) {
+		return core.StatusRedirectError, err.Error()
+	}
+	return core.StatusFetchError, err.Error() // http request error
+}
+
 func (hClient *httpClient) buildHttpParams(req *core.Task) (param *clientParams, err error) {
 
 	param = &clientParams{
 		redirectTimes:  defaultMaxRedirects,
-		retryTimes:     defaultRetryTimes,
-		retryInterval:  defaultRetryInterval,
+		retry:          core.TaskRetryPolicy(req),
 		connectTimeout: defaultConnectTimeout,
+		tlsTimeout:     defaultTLSTimeout,
 		readTimeout:    defaultReadTimeout,
 		header:         make(http.Header),
 	}
@@ -123,14 +234,18 @@ func (hClient *httpClient) buildHttpParams(req *core.Task) (param *clientParams,
 		return nil, err
 	}
 
-	var strProxy = req.Fetch.Proxy
-	if strProxy != "" {
-		if strings.Index(strProxy, "://") < 0 {
-			strProxy = "http://" + strProxy
-		}
-		if param.proxy, err = url.Parse(strProxy); err != nil {
+	param.task = req
+	param.tls = core.TaskTLSConfig(req)
+	param.bodyPolicy = core.TaskBodyPolicy(req)
+	if param.tlsConfig, err = hClient.transports.tlsConfig(param.tls); err != nil {
+		return nil, fmt.Errorf("invalid tls config: %v", err)
+	}
+	if req.Fetch.Proxy != "" {
+		if param.proxy, err = parseProxy(req.Fetch.Proxy); err != nil {
 			return nil, err
 		}
+	} else {
+		param.pooled = hClient.proxies != nil
 	}
 
 	var ckMap = make(map[string]string)
@@ -162,39 +277,55 @@ func (hClient *httpClient) buildHttpParams(req *core.Task) (param *clientParams,
 		param.header.Set("Cookie", strings.Join(kvArr, "; "))
 	}
 
-	switch method := strings.ToUpper(req.Fetch.Method); method {
-	case "GET", "HEAD":
-		param.method = method
-	case "POST":
-		param.method = method
-		if contentType := param.header.Get("Content-Type"); len(contentType) < 1 {
-			param.header.Add("Content-Type", "application/x-www-form-urlencoded")
-		}
-		param.body = strings.NewReader(req.Fetch.Data)
-	default:
+	// it is meant for the proxy, the transport sends it there, see proxyAuthTransport
+	param.proxyAuth = param.header.Get("Proxy-Authorization")
+	param.header.Del("Proxy-Authorization")
+
+	if req.Fetch.UseGzip && param.header.Get("Accept-Encoding") == "" {
+		param.header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	if param.method = strings.ToUpper(req.Fetch.Method); param.method == "" {
 		param.method = "GET"
 	}
+	if !httpMethods[param.method] {
+		return nil, fmt.Errorf("unsupported method %v", req.Fetch.Method)
+	}
+	body, contentType, err := requestBody(&req.Fetch)
+	if err != nil {
+		return nil, err
+	}
+	if contentType == "" && param.method == "POST" {
+		contentType = formContentType
+	}
+	if body != nil || param.method == "POST" {
+		// a bytes.Reader may be read again, by the retries and the redirects
+		param.body = bytes.NewReader(body)
+	}
+	if contentType != "" && (param.header.Get("Content-Type") == "" || len(req.Fetch.Files) > 0) { // the boundary is ours
+		param.header.Set("Content-Type", contentType)
+	}
 	if req.Fetch.MaxRedirects > 0 {
 		param.redirectTimes = req.Fetch.MaxRedirects
 	}
+	param.stopAtRedirect = req.Fetch.StopAtRedirect
 
-	var connectTimeout time.Duration
-	if req.Fetch.ConnectTimeout > 0 {
-		connectTimeout = time.Duration(req.Fetch.ConnectTimeout)
-	}
-	var readTimeout time.Duration
 	if req.Fetch.Timeout > 0 {
-		readTimeout = time.Duration(req.Fetch.Timeout)
+		param.readTimeout = time.Duration(req.Fetch.Timeout) * time.Second
 	}
-
-	if connectTimeout > readTimeout {
-		connectTimeout = readTimeout
+	if req.Fetch.ConnectTimeout > 0 {
+		param.connectTimeout = time.Duration(req.Fetch.ConnectTimeout) * time.Second
+	}
+	if param.connectTimeout > param.readTimeout {
+		param.connectTimeout = param.readTimeout
 	}
-	if connectTimeout > 0 {
-		param.connectTimeout = connectTimeout * time.Second
+	if req.Fetch.TLSTimeout > 0 {
+		param.tlsTimeout = time.Duration(req.Fetch.TLSTimeout) * time.Second
 	}
-	if readTimeout > 0 {
-		param.readTimeout = readTimeout * time.Second
+	// the response header can not take longer than the whole fetch
+	param.headerTimeout = param.readTimeout
+	if timeout := time.Duration(req.Fetch.HeaderTimeout) * time.Second; timeout > 0 && timeout < param.headerTimeout {
+		param.headerTimeout = timeout
 	}
 
 	return
@@ -202,14 +333,25 @@ func (hClient *httpClient) buildHttpParams(req *core.Task) (param *clientParams,
 
 func (param *clientParams) checkRedirect(req *http.Request, via []*http.Request) error {
 
+	if param.stopAtRedirect {
+		return http.ErrUseLastResponse
+	}
+	if req.Response != nil {
+		param.redirects = append(param.redirects, core.RedirectHop{
+			Url:        req.Response.Request.URL.String(),
+			StatusCode: req.Response.StatusCode,
+			Headers:    req.Response.Header,
+		})
+	}
+
 	if param.redirectTimes == 0 {
 		return nil
 	}
 	if len(via) >= param.redirectTimes {
 		if param.redirectTimes < 0 {
-			return fmt.Errorf("not allow redirects")
+			return &redirectError{msg: "not allow redirects"}
 		}
-		return fmt.Errorf("stopped after %v redirects", param.redirectTimes)
+		return &redirectError{msg: fmt.Sprintf("stopped after %v redirects", param.redirectTimes)}
 	}
 
 	newCks := req.Cookies()
@@ -244,56 +386,98 @@ func (hClient *httpClient) buildHttpClient(param *clientParams) *http.Client {
 		client.Jar.SetCookies(param.url, cks)
 	}
 
-	transport := &http.Transport{DialContext: (&net.Dialer{Timeout: param.readTimeout}).DialContext}
-	if param.proxy != nil {
-		transport.Proxy = http.ProxyURL(param.proxy)
-	}
-	if strings.ToLower(param.url.Scheme) == "https" {
-		transport.TLSClientConfig = &tls.Config{RootCAs: nil, InsecureSkipVerify: true}
-		transport.DisableCompression = true
-	}
-	client.Transport = transport
+	client.Transport = hClient.transports.get(param)
 	return client
 }
 
+// doRequest send the request, and again as long as the retry policy allows, every attempt is recorded
 func (hClient *httpClient) doRequest(param *clientParams) (resp *http.Response, err error) {
-	if req, eReq := http.NewRequest(param.method, param.url.String(), param.body); eReq != nil {
-		return nil, eReq
-	} else {
-		req.Header = param.header
-		if param.retryTimes <= 0 { // not allowed to retry
-			resp, err = param.client.Do(req)
-		} else {
-			for i := 0; i < param.retryTimes; i++ {
-				if resp, err = param.client.Do(req); err == nil {
-					break
-				}
-				if i+1 < param.retryTimes {
-					time.Sleep(param.retryInterval)
-				}
+	var req *http.Request
+	if req, err = http.NewRequest(param.method, param.url.String(), param.body); err != nil {
+		return nil, err
+	}
+	req.Header = param.header
+	param.deadline = time.Now().Add(param.readTimeout)
+
+	for retry := 0; ; retry++ {
+		if retry > 0 && req.GetBody != nil { // the body is read by the last attempt
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
 			}
 		}
+		if param.timer != nil {
+			param.timer.stop()
+		}
+		param.timer = newFetchTimer(param)
+		param.trace = newFetchTrace()
+		param.redirects = nil
+		if param.pooled {
+			hClient.pickProxy(param)
+		}
+
+		start := time.Now()
+		resp, err = param.client.Do(req.WithContext(param.trace.context(param.timer.ctx)))
+		attempt := core.FetchAttempt{TimeMS: int(time.Since(start) / time.Millisecond), Proxy: redactProxy(param.proxy)}
+		if err != nil {
+			attempt.StatusCode, attempt.ErrMessage = fetchError(param, err)
+		} else {
+			attempt.StatusCode = resp.StatusCode
+		}
+		if param.pooledProxy != "" {
+			hClient.proxies.Report(param.pooledProxy, proxyOK(resp, err))
+		}
+
+		wait, again := param.nextAttempt(retry, resp, err)
+		if again {
+			attempt.WaitMS = int(wait / time.Millisecond)
+		}
+		param.attempts = append(param.attempts, attempt)
+		if !again || !hClient.wait(wait) { // the last response is given back as it is on shutdown
+			return resp, err
+		}
+
+		if resp != nil { // drain a bit of it, so the connection may be reused
+			_, _ = io.CopyN(ioutil.Discard, resp.Body, maxDrainSize)
+			_ = resp.Body.Close()
+		}
 	}
-	return
 }
 
-func (hClient *httpClient) deCompressRespBody(resp *http.Response) {
-	switch resp.Header.Get("Content-Encoding") {
-	case "gzip":
-		var gzipReader *gzip.Reader
-		gzipReader, err := gzip.NewReader(resp.Body)
-		if err == nil {
-			resp.Body = gzipReader
-		}
+// wait before the next attempt, false when the fetcher is shut down meanwhile
+func (hClient *httpClient) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-hClient.done:
+		return false
+	}
+}
 
-	case "deflate":
-		resp.Body = flate.NewReader(resp.Body)
+// nextAttempt tells whether to try again after the retry-th retry, and how long to wait before
+func (param *clientParams) nextAttempt(retry int, resp *http.Response, err error) (time.Duration, bool) {
+	if retry >= param.retry.MaxRetries {
+		return 0, false
+	}
+	if err == nil && !param.retry.RetryStatusCode(resp.StatusCode) {
+		return 0, false
+	}
+	if err != nil && (isTLSError(err) || isRedirectError(err)) { // the next time will go the same way
+		return 0, false
+	}
 
-	case "zlib":
-		var readCloser io.ReadCloser
-		readCloser, err := zlib.NewReader(resp.Body)
-		if err == nil {
-			resp.Body = readCloser
+	wait := param.retry.Backoff(retry)
+	if resp != nil {
+		if after := core.RetryAfter(resp.Header, time.Now()); after > wait {
+			if param.retry.MaxDelay > 0 && after > param.retry.MaxDelay { // not worth holding a worker so long
+				return 0, false
+			}
+			wait = after
 		}
 	}
+	if !param.deadline.IsZero() && time.Now().Add(wait).After(param.deadline) { // no time left for another one
+		return 0, false
+	}
+	return wait, true
 }
@@ -0,0 +1,307 @@
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/xgo11/spider/core"
+)
+
+// newTransportEach is how the client worked before, a new transport for every request
+func newTransportEach(hClient *httpClient, param *clientParams) *http.Client {
+	client := hClient.buildHttpClient(param)
+	transport := &http.Transport{DialContext: (&net.Dialer{Timeout: param.readTimeout}).DialContext}
+	if param.url.Scheme == "https" {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client.Transport = transport
+	return client
+}
+
+func benchmarkClient(b *testing.B, tlsServer bool, build func(hClient *httpClient, param *clientParams) *http.Client) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "<html><body>ok</body></html>")
+	})
+	var server *httptest.Server
+	if tlsServer {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+	defer server.Close()
+
+	hClient := &httpClient{transports: newTransportCache(core.TransportConfig{})}
+	task := core.NewTask(server.URL + "/")
+	task.Fetch.TLS = &core.TLSConfig{Insecure: true}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		param, err := hClient.buildHttpParams(task)
+		if err != nil {
+			b.Fatal(err)
+		}
+		param.client = build(hClient, param)
+		resp, err := hClient.doRequest(param)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if tr := param.client.Transport.(*http.Transport); tr != hClient.transports.get(param) {
+			tr.CloseIdleConnections() // the old client leaked them, here it would run out of files
+		}
+	}
+	b.StopTimer()
+	hClient.transports.closeIdle()
+}
+
+func BenchmarkClientNewTransport(b *testing.B) {
+	benchmarkClient(b, false, newTransportEach)
+}
+
+func BenchmarkClientSharedTransport(b *testing.B) {
+	benchmarkClient(b, false, (*httpClient).buildHttpClient)
+}
+
+func BenchmarkClientNewTransportTLS(b *testing.B) {
+	benchmarkClient(b, true, newTransportEach)
+}
+
+func BenchmarkClientSharedTransportTLS(b *testing.B) {
+	benchmarkClient(b, true, (*httpClient).buildHttpClient)
+}
+
+func TestClientTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-header":
+			time.Sleep(1500 * time.Millisecond)
+		case "/slow-body": // drips the body for longer than the whole fetch may take
+			w.(http.Flusher).Flush()
+			for i := 0; i < 10; i++ {
+				_, _ = fmt.Fprint(w, ".")
+				w.(http.Flusher).Flush()
+				time.Sleep(200 * time.Millisecond)
+			}
+		}
+	}))
+	defer server.Close()
+
+	hClient := &httpClient{transports: newTransportCache(core.TransportConfig{})}
+	fetch := func(path string, headerTimeout, timeout int) *core.Response {
+		task := core.NewTask(server.URL + path)
+		task.Fetch.HeaderTimeout = headerTimeout
+		task.Fetch.Timeout = timeout
+		param, _ := hClient.buildHttpParams(task)
+		param.client = hClient.buildHttpClient(param)
+		param.retry.MaxRetries = 0
+
+		resp := &core.Response{}
+		httpResp, err := hClient.doRequest(param)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, httpResp.Body)
+			_ = httpResp.Body.Close()
+		}
+		param.timer.stop()
+		if err != nil {
+			resp.StatusCode, resp.ErrMessage = fetchError(param, err)
+		}
+		return resp
+	}
+
+	if resp := fetch("/slow-header", 1, 5); resp.StatusCode != core.StatusHeaderTimeout {
+		t.Fatalf("slow header should be a header timeout, got %d", resp.StatusCode)
+	}
+	if resp := fetch("/slow-body", 0, 1); resp.StatusCode != core.StatusTotalTimeout {
+		t.Fatalf("slow body should be a total timeout, got %d", resp.StatusCode)
+	}
+	if resp := fetch("/", 1, 1); resp.StatusCode != 0 {
+		t.Fatalf("fast fetch should not time out, got %d", resp.StatusCode)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var calls = 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case r.URL.Path == "/flaky" && calls == 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/flaky" && calls == 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/busy":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	hClient := &httpClient{transports: newTransportCache(core.TransportConfig{})}
+	fetch := func(path string) []core.FetchAttempt {
+		calls = 0
+		param, _ := hClient.buildHttpParams(core.NewTask(server.URL + path))
+		param.client = hClient.buildHttpClient(param)
+		param.retry = core.RetryPolicy{MaxRetries: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 2 * time.Second,
+			RetryStatus: core.DefaultRetryPolicy.RetryStatus}
+		if resp, err := hClient.doRequest(param); err == nil {
+			_ = resp.Body.Close()
+		}
+		param.timer.stop()
+		return param.attempts
+	}
+
+	attempts := fetch("/flaky")
+	if len(attempts) != 3 || attempts[0].StatusCode != 503 || attempts[1].StatusCode != 429 || attempts[2].StatusCode != 200 {
+		t.Fatalf("should retry until ok, got %+v", attempts)
+	}
+	if attempts[0].WaitMS < 1000 || attempts[1].WaitMS < 10 || attempts[1].WaitMS > 20 || attempts[2].WaitMS != 0 {
+		t.Fatalf("should wait as Retry-After asks, or back off, got %+v", attempts)
+	}
+	if attempts = fetch("/busy"); len(attempts) != 1 {
+		t.Fatalf("should give up on a Retry-After over the max delay, got %+v", attempts)
+	}
+	if attempts = fetch("/missing"); len(attempts) != 1 || attempts[0].StatusCode != 404 {
+		t.Fatalf("should not retry a status out of the policy, got %+v", attempts)
+	}
+}
+
+func TestClientRetryStops(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprint(w, "busy")
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	done := make(chan struct{})
+	hClient := &httpClient{transports: newTransportCache(core.TransportConfig{}), done: done}
+	fetch := func(task *core.Task) (*http.Response, []core.FetchAttempt) {
+		param, _ := hClient.buildHttpParams(task)
+		param.client = hClient.buildHttpClient(param)
+		param.retry = core.RetryPolicy{MaxRetries: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 2 * time.Second,
+			RetryStatus: core.DefaultRetryPolicy.RetryStatus}
+		resp, _ := hClient.doRequest(param)
+		param.timer.stop()
+		return resp, param.attempts
+	}
+
+	if _, attempts := fetch(core.NewTask(tlsServer.URL)); len(attempts) != 1 || attempts[0].StatusCode != core.StatusTLSError {
+		t.Fatalf("should not retry an untrusted certificate, got %+v", attempts)
+	}
+	task := core.NewTask(server.URL + "/loop")
+	task.Fetch.MaxRedirects = 2
+	if _, attempts := fetch(task); len(attempts) != 1 || attempts[0].StatusCode != core.StatusRedirectError {
+		t.Fatalf("should not retry a fetch stopped by the redirect policy, got %+v", attempts)
+	}
+
+	task = core.NewTask(server.URL)
+	task.Fetch.Timeout = 1
+	if _, attempts := fetch(task); len(attempts) != 1 {
+		t.Fatalf("the waits should count in the timeout of the whole fetch, got %+v", attempts)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { close(done) })
+	start := time.Now()
+	resp, attempts := fetch(core.NewTask(server.URL))
+	if time.Since(start) > 500*time.Millisecond || len(attempts) != 1 {
+		t.Fatalf("shutdown should end the wait, got %+v after %v", attempts, time.Since(start))
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "busy" {
+		t.Fatalf("the last response should be given back as it is, got %q", body)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestClientDecoding(t *testing.T) {
+	const text = "<html><body>decoded</body></html>"
+	encoders := map[string]func(w io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"br":   func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			z, _ := zstd.NewWriter(w)
+			return z
+		},
+	}
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		content := []byte(text)
+		encodings := r.URL.Query().Get("encodings")
+		for _, enc := range strings.Split(encodings, ",") {
+			if encode, ok := encoders[strings.TrimSpace(enc)]; ok {
+				buf := &bytes.Buffer{}
+				wc := encode(buf)
+				_, _ = wc.Write(content)
+				_ = wc.Close()
+				content = buf.Bytes()
+			}
+		}
+		w.Header().Set("Content-Encoding", encodings)
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/not-encoded":
+			_, _ = w.Write([]byte(text))
+		default:
+			_, _ = w.Write(content)
+		}
+	}))
+	defer server.Close()
+
+	hClient := &httpClient{transports: newTransportCache(core.TransportConfig{})}
+	fetchPath := func(method, path, encodings string) *core.Response {
+		task := core.NewTask(server.URL + path + "?encodings=" + encodings)
+		task.Fetch.Method = method
+		task.Fetch.UseGzip = true
+		return hClient.Do(task)
+	}
+	fetch := func(encodings string) *core.Response {
+		return fetchPath("GET", "/", encodings)
+	}
+
+	for _, encodings := range []string{"gzip", "br", "zstd", "gzip,%20br", "br,zstd,gzip"} {
+		if resp := fetch(encodings); resp.ErrMessage != "" || string(resp.Content) != text {
+			t.Fatalf("should decode %v, got %v %q", encodings, resp.ErrMessage, resp.Content)
+		}
+	}
+	if acceptEncoding != "gzip, deflate, br, zstd" {
+		t.Fatalf("use_gzip should accept the encodings decoded, got %q", acceptEncoding)
+	}
+	resp := fetch("compress")
+	if resp.StatusCode != core.StatusDecodeError || resp.ErrMessage != "unsupported content encoding compress" || string(resp.Content) != text {
+		t.Fatalf("should tell an unknown encoding, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Content)
+	}
+	resp = fetchPath("GET", "/not-encoded", "gzip")
+	if resp.StatusCode != core.StatusDecodeError || string(resp.Content) != text {
+		t.Fatalf("content not of its encoding should be left as it came, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Content)
+	}
+	for _, r := range []*core.Response{fetchPath("HEAD", "/", "gzip"), fetchPath("GET", "/no-content", "gzip")} {
+		if r.ErrMessage != "" || len(r.Content) != 0 {
+			t.Fatalf("an empty body should not be decoded, got %v %v", r.StatusCode, r.ErrMessage)
+		}
+	}
+}
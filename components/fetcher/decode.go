@@ -0,0 +1,153 @@
+package fetcher
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding is what TaskFetcher.UseGzip asks for, all of it can be decoded
+const acceptEncoding = "gzip, deflate, br, zstd"
+
+type decoder func(r io.Reader) (io.ReadCloser, error)
+
+// decoders of the Content-Encoding values
+var decoders = map[string]decoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	},
+	"zlib": func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	},
+	"br": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	},
+	"zstd": func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+}
+
+func init() {
+	decoders["x-gzip"] = decoders["gzip"]
+}
+
+// contentEncodings returns the encodings of a response, in the order they were applied
+func contentEncodings(header http.Header) (encodings []string) {
+	for _, value := range header["Content-Encoding"] {
+		for _, enc := range strings.Split(value, ",") {
+			if enc = strings.ToLower(strings.TrimSpace(enc)); enc != "" && enc != "identity" {
+				encodings = append(encodings, enc)
+			}
+		}
+	}
+	return
+}
+
+// decodedBody reads the decoded body, closing the decoders with the body
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *decodedBody) Close() (err error) {
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		if e := b.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// recordReader keeps what is read of its reader in record, until stop is called.
+// Some decoders read ahead in their own goroutine, so record is only touched under the lock.
+type recordReader struct {
+	sync.Mutex
+	io.Reader
+	record *bytes.Buffer
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.Lock()
+	if r.record != nil {
+		r.record.Write(p[:n])
+	}
+	r.Unlock()
+	return n, err
+}
+
+// stop recording, and return what is recorded
+func (r *recordReader) stop() *bytes.Buffer {
+	r.Lock()
+	defer r.Unlock()
+	record := r.record
+	r.record = nil
+	return record
+}
+
+// hasBody tells whether resp may have a body to decode, the responses to HEAD, 204 and 304 never have
+func hasBody(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+	return resp.ContentLength != 0
+}
+
+// decodeBody undo the Content-Encoding of resp, the last applied first. When an encoding is unknown
+// or the content is not of it, the body is left as it came and the error is returned.
+func decodeBody(resp *http.Response) error {
+	encodings := contentEncodings(resp.Header)
+	if len(encodings) == 0 || !hasBody(resp) {
+		return nil
+	}
+	for _, enc := range encodings {
+		if _, ok := decoders[enc]; !ok {
+			return fmt.Errorf("unsupported content encoding %v", enc)
+		}
+	}
+
+	// the decoders read the head of the content to start, it is kept to be given back on a failure
+	raw := &recordReader{Reader: resp.Body, record: &bytes.Buffer{}}
+	body := &decodedBody{Reader: raw, closers: []io.Closer{resp.Body}}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		r, err := decoders[encodings[i]](body.Reader)
+		if err != nil {
+			body.closers = body.closers[1:] // but the body
+			_ = body.Close()
+			record := raw.stop()
+			resp.Body = &decodedBody{Reader: io.MultiReader(record, resp.Body), closers: []io.Closer{resp.Body}}
+			if err == io.EOF && record.Len() == 0 { // an empty body of no length
+				return nil
+			}
+			return fmt.Errorf("invalid %v content: %v", encodings[i], err)
+		}
+		body.Reader = r
+		body.closers = append(body.closers, r)
+	}
+	raw.stop()
+	resp.Body = body
+	return nil
+}
@@ -2,6 +2,8 @@ package fetcher
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -22,29 +24,49 @@ type httpFetcher struct {
 	schedule2FetcherQ  core.IQueue
 	fetcher2ProcessorQ core.IQueue
 	statusQ            core.IQueue
+	inbox              *core.Inbox
 	hooks              []core.FetcherHook
+	workers            int
+	perHost            int
+	client             *httpClient
+	done               chan struct{} // closed on shutdown
 	wg                 *sync.WaitGroup
 	pause              bool
 	isRunning          bool
 }
 
 const (
-	sleepIdle = 3000 * time.Millisecond
-	loopSize  = 20
+	sleepIdle       = 3000 * time.Millisecond
+	defaultWorkers  = 20
+	requeueInterval = 30 * time.Second
+	receiveTimeout  = time.Second // how long one blocking pop waits, bounds the shutdown latency
 )
 
 var (
 	logger = common.GetLogger("fetcher")
+
+	_ core.ITunableFetcher   = &httpFetcher{}
+	_ core.IDeadLetterRouter = &httpFetcher{}
 )
 
 func (hf *httpFetcher) Shutdown() {
 	hf.Lock()
-	hf.pause = true
+	if !hf.pause {
+		hf.pause = true
+		close(hf.done)
+	}
 	hf.Unlock()
 	hf.wg.Wait()
+	hf.client.transports.closeIdle()
 	logger.Infof("safe stopped")
 }
 
+func (hf *httpFetcher) paused() bool {
+	hf.Lock()
+	defer hf.Unlock()
+	return hf.pause
+}
+
 func (hf *httpFetcher) Run() {
 	hf.Lock()
 	if hf.isRunning {
@@ -55,28 +77,59 @@ func (hf *httpFetcher) Run() {
 	hf.isRunning = true
 	hf.Unlock()
 
-	logger.Infof("starting ...")
+	// the run loop is counted too, so Shutdown can not miss a job it starts
+	hf.wg.Add(1)
+	defer hf.wg.Done()
+
+	logger.WithField("workers", hf.workers).WithField("per_host", hf.perHost).Infof("starting ...")
 
-	var oneLoopSize = loopSize
+	pool := newFetchPool(hf.workers, hf.perHost, hf.wg, func(job *fetchJob) {
+		hf.runOneTask(job.msg, job.task)
+	})
+	var lastRequeue = time.Now()
 
-	for !hf.pause {
-		messages := hf.schedule2FetcherQ.Pop(oneLoopSize)
-		count := len(messages)
+	for !hf.paused() {
+		if time.Since(lastRequeue) >= requeueInterval {
+			if cnt := core.Requeue(hf.schedule2FetcherQ); cnt > 0 {
+				logger.WithField("count", cnt).Warn("requeue expired messages")
+			}
+			lastRequeue = time.Now()
+		}
 
-		if count > 0 {
+		if core.IsCongested(hf.fetcher2ProcessorQ) { // let the processors catch up
+			logger.WithField("queue", hf.fetcher2ProcessorQ.Name()).Debug("downstream congested")
+			time.Sleep(sleepIdle)
+			continue
+		}
+
+		pool.reap(0)
+		free := pool.free()
+		if free < 1 { // wait for a worker
+			pool.reap(receiveTimeout)
+			continue
+		}
+
+		messages := core.Receive(hf.schedule2FetcherQ, free, receiveTimeout)
+		if len(messages) > 0 {
 			for _, msg := range messages {
+				if core.Attempts(hf.schedule2FetcherQ, msg) > core.MaxDeliveryAttempts {
+					logger.WithField("op", "abandon").Error("too many attempts")
+					hf.inbox.Dead(msg, core.DeadReasonRetryExceeded, nil)
+					continue
+				}
 				body := core.Schedule2FetchMessage{}
 				if err := json.Unmarshal([]byte(msg), &body); err != nil || body.Task == nil {
-					logger.WithError(err).WithField("op", "abandon").Error(msg[0:300])
+					logger.WithError(err).WithField("op", "abandon").Error("invalid message")
+					hf.inbox.Dead(msg, core.DeadReasonInvalidMessage, err)
 					continue
 				}
-				go hf.runOneTask(body.Task)
+				pool.submit(&fetchJob{msg: msg, task: body.Task, host: core.TaskHost(body.Task)})
 			}
 		}
+	}
 
-		if count < oneLoopSize {
-			time.Sleep(sleepIdle)
-		}
+	for _, job := range pool.close() { // give back what never started
+		hf.inbox.Release(job.msg)
 	}
 
 	hf.Lock()
@@ -86,6 +139,41 @@ func (hf *httpFetcher) Run() {
 	return
 }
 
+func (hf *httpFetcher) SetDeadLetterQueue(q core.IQueue) {
+	hf.Lock()
+	defer hf.Unlock()
+	hf.inbox.DeadQ = q
+}
+
+// SetConcurrency set how many tasks are fetched at the same time, and at most how many of them
+// go to one host, 0 is unlimited. It takes effect on the next Run.
+func (hf *httpFetcher) SetConcurrency(workers int, perHost int) {
+	hf.Lock()
+	defer hf.Unlock()
+	if workers > 0 {
+		hf.workers = workers
+	}
+	if perHost >= 0 {
+		hf.perHost = perHost
+	}
+}
+
+// SetTransportConfig set the connection pools of the transports, it should be called before Run
+func (hf *httpFetcher) SetTransportConfig(conf core.TransportConfig) {
+	hf.Lock()
+	defer hf.Unlock()
+	old := hf.client.transports
+	hf.client = &httpClient{transports: newTransportCache(conf), proxies: hf.client.proxies, done: hf.done}
+	old.closeIdle()
+}
+
+// SetProxyProvider set where the tasks without a Fetch.Proxy take their proxies, it should be called before Run
+func (hf *httpFetcher) SetProxyProvider(provider core.IProxyProvider) {
+	hf.Lock()
+	defer hf.Unlock()
+	hf.client = &httpClient{transports: hf.client.transports, proxies: provider, done: hf.done}
+}
+
 func (hf *httpFetcher) HttpServe() http.HandlerFunc {
 	//gin.SetMode(gin.ReleaseMode)
 	engine := gin.Default()
@@ -100,9 +188,12 @@ func (hf *httpFetcher) HttpServe() http.HandlerFunc {
 			task := core.Task{}
 			if err = json.Unmarshal(reqBytes, &task); err == nil {
 				resp := hf.fetch(&task)
-				resp.GetEncoding()
-				out := core.Fetch2ProcessMessage{Task: &task, Response: resp}
-				ctx.JSON(http.StatusOK, out)
+				// the body travels in the answer, nothing would delete its blob
+				if err = inlineBlob(resp); err == nil {
+					resp.GetEncoding()
+					out := core.Fetch2ProcessMessage{Task: &task, Response: resp}
+					ctx.JSON(http.StatusOK, out)
+				}
 			}
 		}
 
@@ -113,14 +204,45 @@ func (hf *httpFetcher) HttpServe() http.HandlerFunc {
 	return engine.ServeHTTP
 }
 
-func (hf *httpFetcher) runOneTask(task *core.Task) {
-	hf.wg.Add(1)
-	defer hf.wg.Done()
+func (hf *httpFetcher) runOneTask(msg string, task *core.Task) {
+	defer func() {
+		if e := recover(); e != nil {
+			logger.WithFields(logrus.Fields{
+				"op":     "abandon",
+				"taskid": task.TaskId,
+				"panic":  e,
+			}).Error("fetch panic")
+			err := fmt.Errorf("%v", e)
+			hf.inbox.Dead(msg, core.DeadReasonPanic, err)
+			hf.sendStatus(task, core.TaskStatusFailed, err)
+		}
+	}()
 
-	if resp := hf.fetch(task); resp != nil {
-		hf.onSendMessage(task, resp)
+	resp := hf.fetch(task)
+	if resp == nil {
+		err := errors.New("invalid url")
+		hf.inbox.Dead(msg, core.DeadReasonInvalidMessage, err)
+		hf.sendStatus(task, core.TaskStatusFailed, err)
+		return
+	}
+	if err := hf.onSendMessage(task, resp); err != nil {
+		deleteBlob(resp) // it is fetched again
+		hf.inbox.GiveBack(msg, err)
+		return
 	}
+	hf.inbox.Ack(msg) // only after it is handed to the processor
 
+	if resp.ErrMessage != "" {
+		hf.sendStatus(task, core.TaskStatusFailed, errors.New(resp.ErrMessage))
+	} else {
+		hf.sendStatus(task, core.TaskStatusCrawled, nil)
+	}
+}
+
+func (hf *httpFetcher) sendStatus(task *core.Task, status int, err error) {
+	if e := core.SendStatus(hf.statusQ, core.StageFetcher, task, status, err); e != nil {
+		logger.WithError(e).WithField("taskid", task.TaskId).WithField("op", "sendStatus").Error("fail")
+	}
 }
 
 func (hf *httpFetcher) fetch(task *core.Task) (resp *core.Response) {
@@ -145,7 +267,7 @@ func (hf *httpFetcher) fetch(task *core.Task) (resp *core.Response) {
 
 	// http requests
 	hf.beforeReq(task)
-	resp = (&httpClient{}).Do(task)
+	resp = hf.client.Do(task)
 
 	if resp.ErrMessage == "" {
 		hf.onFetchSuccess(task, resp)
@@ -179,7 +301,25 @@ func (hf *httpFetcher) onFetchSuccess(task *core.Task, resp *core.Response) {
 		"url":         task.Url,
 		"cost":        resp.TimeMS,
 		"status_code": resp.StatusCode,
-	}).Info("ok")
+		"attempts":    len(resp.Attempts),
+	}).WithFields(timingFields(resp.Timing)).Info("ok")
+}
+
+// timingFields log the timing of a fetch
+func timingFields(timing *core.FetchTiming) logrus.Fields {
+	if timing == nil {
+		return logrus.Fields{}
+	}
+	return logrus.Fields{
+		"dns":        timing.DNSMS,
+		"connect":    timing.ConnectMS,
+		"tls":        timing.TLSMS,
+		"server":     timing.ServerMS,
+		"first_byte": timing.FirstByteMS,
+		"remote_ip":  timing.RemoteIP,
+		"proto":      timing.Proto,
+		"reused":     timing.Reused,
+	}
 }
 
 func (hf *httpFetcher) onFetchError(task *core.Task, resp *core.Response) {
@@ -189,15 +329,16 @@ func (hf *httpFetcher) onFetchError(task *core.Task, resp *core.Response) {
 		"cost":        resp.TimeMS,
 		"status_code": resp.StatusCode,
 		"error":       resp.ErrMessage,
-		"proxy":       task.Fetch.Proxy,
-	}).Error("fail")
+		"attempts":    len(resp.Attempts),
+		"proxy":       resp.Proxy,
+	}).WithFields(timingFields(resp.Timing)).Error("fail")
 }
 
-func (hf *httpFetcher) onSendMessage(task *core.Task, resp *core.Response) {
+func (hf *httpFetcher) onSendMessage(task *core.Task, resp *core.Response) error {
 	var bytes []byte
 	var err error
 	if bytes, err = json.Marshal(core.Fetch2ProcessMessage{Task: task, Response: resp}); err == nil {
-		err = hf.fetcher2ProcessorQ.Put(string(bytes))
+		err = core.PutWait(hf.fetcher2ProcessorQ, core.HandOffStop(hf.paused), string(bytes))
 	}
 	if err != nil {
 		logger.WithError(err).WithFields(logrus.Fields{
@@ -206,6 +347,7 @@ func (hf *httpFetcher) onSendMessage(task *core.Task, resp *core.Response) {
 			"project": task.Project,
 		}).Error()
 	}
+	return err
 }
 
 func (hf *httpFetcher) beforeReq(task *core.Task) {
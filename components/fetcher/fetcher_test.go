@@ -0,0 +1,206 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+// sliceQueue is a plain core.IQueue, the fetcher polls it and gives back by Put
+type sliceQueue struct {
+	sync.Mutex
+	name     string
+	messages []string
+}
+
+func (q *sliceQueue) Name() string {
+	return q.name
+}
+
+func (q *sliceQueue) Put(message ...string) error {
+	q.Lock()
+	defer q.Unlock()
+	q.messages = append(q.messages, message...)
+	return nil
+}
+
+func (q *sliceQueue) Pop(count ...int) []string {
+	q.Lock()
+	defer q.Unlock()
+	n := 1
+	if len(count) > 0 {
+		n = count[0]
+	}
+	if n > len(q.messages) {
+		n = len(q.messages)
+	}
+	out := q.messages[:n:n]
+	q.messages = q.messages[n:]
+	return out
+}
+
+func (q *sliceQueue) Size() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.messages)
+}
+
+func (q *sliceQueue) Limit() int {
+	return 0
+}
+
+// newTask build a task as spider.UrlTask does
+func newTask(url string, kwArgs map[string]interface{}) *core.Task {
+	task := core.NewTask(url)
+	task.Update(kwArgs)
+	return task
+}
+
+func newTestFetcher(hooks ...core.FetcherHook) *httpFetcher {
+	return NewFetcher(&sliceQueue{name: "s2f"}, &sliceQueue{name: "f2p"}, nil, hooks...).(*httpFetcher)
+}
+
+// fetchTask fetch task once, without the retries of the client
+func fetchTask(task *core.Task) *core.Response {
+	task.Fetch.Retries = -1
+	return newTestFetcher().fetch(task)
+}
+
+func TestFetcherHttpServe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	body, _ := json.Marshal(newTask(server.URL, nil))
+	rec := httptest.NewRecorder()
+	newTestFetcher().HttpServe()(rec, httptest.NewRequest(http.MethodPost, "/fetch", strings.NewReader(string(body))))
+
+	out := core.Fetch2ProcessMessage{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || out.Task == nil || out.Response == nil {
+		t.Fatalf("should answer the task and its response, got %v %v", err, rec.Body.String())
+	}
+	if out.Response.StatusCode != 200 || string(out.Response.Content) != "hello" {
+		t.Fatalf("should fetch the task, got %v %v", out.Response.StatusCode, out.Response.ErrMessage)
+	}
+}
+
+func TestFetcherWorkerPool(t *testing.T) {
+	var mu sync.Mutex
+	var started, running, maxRunning = 0, 0, 0
+	var hostRunning, maxHostRunning = map[string]int{}, map[string]int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		mu.Lock()
+		started++
+		running++
+		hostRunning[host]++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		if hostRunning[host] > maxHostRunning[host] {
+			maxHostRunning[host] = hostRunning[host]
+		}
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		hostRunning[host]--
+		mu.Unlock()
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	s2fQ, f2pQ := &sliceQueue{name: "s2f"}, &sliceQueue{name: "f2p"}
+	f := NewFetcher(s2fQ, f2pQ, nil).(*httpFetcher)
+	f.SetConcurrency(3, 2)
+
+	for i := 0; i < 6; i++ {
+		for _, host := range []string{"127.0.0.1", "localhost"} {
+			task := newTask(fmt.Sprintf("http://%s:%s/%d", host, port, i), nil)
+			bytes, _ := json.Marshal(map[string]interface{}{"task": task})
+			_ = s2fQ.Put(string(bytes))
+		}
+	}
+	go f.Run()
+
+	for i := 0; i < 100 && f2pQ.Size() < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if running != 0 || f2pQ.Size() != started {
+		t.Fatalf("shutdown should drain the started fetches, %d running, %d started, %d sent", running, started, f2pQ.Size())
+	}
+	if maxRunning > 3 || maxHostRunning["127.0.0.1"] > 2 || maxHostRunning["localhost"] > 2 {
+		t.Fatalf("concurrency over the caps, total %d, per host %v", maxRunning, maxHostRunning)
+	}
+	if started+s2fQ.Size() != 12 {
+		t.Fatalf("tasks not started should be given back, %d started, %d left", started, s2fQ.Size())
+	}
+}
+
+// fixedProxy is a core.IProxyProvider of a single proxy, it counts the outcomes reported
+type fixedProxy struct {
+	sync.Mutex
+	proxy    string
+	outcomes map[bool]int
+}
+
+func (p *fixedProxy) Get(task *core.Task) string {
+	return p.proxy
+}
+
+func (p *fixedProxy) Report(proxy string, ok bool) {
+	p.Lock()
+	defer p.Unlock()
+	if proxy == p.proxy {
+		p.outcomes[ok]++
+	}
+}
+
+func TestFetcherProxyProvider(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/banned": // the origin turns the proxy down
+			w.WriteHeader(http.StatusForbidden)
+			return
+		case "/auth": // the proxy itself turns the request down
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "via proxy %v", r.URL.Host) // a proxy is asked the absolute url
+	}))
+	defer proxy.Close()
+
+	provider := &fixedProxy{proxy: proxy.URL, outcomes: map[bool]int{}}
+	f := newTestFetcher()
+	f.SetProxyProvider(provider)
+
+	resp := f.fetch(newTask("http://spider.invalid/", nil))
+	if string(resp.Content) != "via proxy spider.invalid" || resp.Proxy != proxy.URL {
+		t.Fatalf("should fetch through the provider, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Content)
+	}
+	f.fetch(newTask("http://spider.invalid/banned", nil))
+	f.fetch(newTask("http://spider.invalid/auth", nil))
+	provider.Lock()
+	defer provider.Unlock()
+	if provider.outcomes[true] != 2 || provider.outcomes[false] != 1 {
+		t.Fatalf("only a 407 should count against the proxy, got %v", provider.outcomes)
+	}
+}
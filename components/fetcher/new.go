@@ -8,10 +8,15 @@ import (
 )
 
 func NewFetcher(scheduler2FetcherQ, fetcher2ProcessorQ, statusQ core.IQueue, hooks ...core.FetcherHook) core.IFetcher {
+	done := make(chan struct{})
 	hf := &httpFetcher{
 		schedule2FetcherQ:  scheduler2FetcherQ,
 		fetcher2ProcessorQ: fetcher2ProcessorQ,
 		statusQ:            statusQ,
+		inbox:              &core.Inbox{Stage: core.StageFetcher, Queue: scheduler2FetcherQ, Logger: logger},
+		workers:            defaultWorkers,
+		client:             &httpClient{transports: newTransportCache(core.TransportConfig{}), done: done},
+		done:               done,
 		wg:                 &sync.WaitGroup{},
 		pause:              false,
 		isRunning:          false,
@@ -0,0 +1,144 @@
+package fetcher
+
+import (
+	"sync"
+	"time"
+)
+import (
+	"github.com/xgo11/spider/core"
+)
+
+type fetchJob struct {
+	msg  string
+	task *core.Task
+	host string
+}
+
+// fetchPool is a fixed number of workers fetching the jobs submitted by the run loop,
+// it is owned by the run loop, only the jobs and done channels are shared with the workers
+type fetchPool struct {
+	size     int
+	perHost  int // at most so many jobs of one host at the same time, 0 is unlimited
+	busy     int
+	hostBusy map[string]int
+	parked   map[string][]*fetchJob // jobs waiting for their host, in arrival order
+	nParked  int
+	jobs     chan *fetchJob
+	done     chan *fetchJob
+	wg       *sync.WaitGroup
+}
+
+const (
+	parkFactor = 4 // at most size*parkFactor jobs wait for their host, they are leased from the queue meanwhile
+)
+
+func newFetchPool(size, perHost int, wg *sync.WaitGroup, work func(job *fetchJob)) *fetchPool {
+	p := &fetchPool{
+		size:     size,
+		perHost:  perHost,
+		hostBusy: map[string]int{},
+		parked:   map[string][]*fetchJob{},
+		jobs:     make(chan *fetchJob, size),
+		done:     make(chan *fetchJob, size),
+		wg:       wg,
+	}
+	for i := 0; i < size; i++ {
+		go func() {
+			for job := range p.jobs {
+				work(job)
+				p.wg.Done()
+				p.done <- job
+			}
+		}()
+	}
+	return p
+}
+
+// free tells how many more jobs can be taken, the parked ones do not hold a worker so the other hosts
+// keep flowing while one is at its cap, until too many are parked
+func (p *fetchPool) free() int {
+	if p.nParked >= p.size*parkFactor {
+		return 0
+	}
+	return p.size - p.busy
+}
+
+// submit start job at once, or park it when its host is at the cap
+func (p *fetchPool) submit(job *fetchJob) {
+	if len(p.parked[job.host]) == 0 && p.hasRoom(job) {
+		p.start(job)
+	} else {
+		p.parked[job.host] = append(p.parked[job.host], job)
+		p.nParked++
+	}
+}
+
+func (p *fetchPool) hasRoom(job *fetchJob) bool {
+	if p.busy >= p.size {
+		return false
+	}
+	return p.perHost <= 0 || job.host == "" || p.hostBusy[job.host] < p.perHost
+}
+
+func (p *fetchPool) start(job *fetchJob) {
+	p.busy++
+	p.hostBusy[job.host]++
+	p.wg.Add(1) // before the job is handed over, so Shutdown waits for it
+	p.jobs <- job
+}
+
+// reap collect the finished jobs and start the parked ones which have room now,
+// when nothing is finished it waits up to timeout for one
+func (p *fetchPool) reap(timeout time.Duration) {
+	var finished = 0
+drain:
+	for {
+		select {
+		case job := <-p.done:
+			p.finish(job)
+			finished++
+		default:
+			break drain
+		}
+	}
+
+	if finished == 0 && timeout > 0 && p.busy > 0 {
+		select {
+		case job := <-p.done:
+			p.finish(job)
+		case <-time.After(timeout):
+		}
+	}
+
+	for host, jobs := range p.parked {
+		for len(jobs) > 0 && p.hasRoom(jobs[0]) {
+			p.start(jobs[0])
+			jobs = jobs[1:]
+			p.nParked--
+		}
+		if len(jobs) == 0 {
+			delete(p.parked, host)
+		} else {
+			p.parked[host] = jobs
+		}
+	}
+}
+
+func (p *fetchPool) finish(job *fetchJob) {
+	p.busy--
+	if p.hostBusy[job.host]--; p.hostBusy[job.host] <= 0 {
+		delete(p.hostBusy, job.host)
+	}
+}
+
+// close stop the workers after the started jobs, and return the jobs never started
+func (p *fetchPool) close() []*fetchJob {
+	close(p.jobs)
+	var parked []*fetchJob
+	for _, jobs := range p.parked {
+		parked = append(parked, jobs...)
+	}
+	p.parked = map[string][]*fetchJob{}
+	p.nParked = 0
+	return parked
+}
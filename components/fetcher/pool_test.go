@@ -0,0 +1,42 @@
+package fetcher
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchPoolParksCappedHosts(t *testing.T) {
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	pool := newFetchPool(3, 1, &wg, func(job *fetchJob) {
+		started <- job.host
+		<-release
+	})
+
+	for i := 0; i < 3; i++ {
+		pool.submit(&fetchJob{msg: "a", host: "a"})
+	}
+	if free := pool.free(); free != 2 {
+		t.Fatalf("jobs waiting for their host should not hold a worker, free %d", free)
+	}
+	pool.submit(&fetchJob{msg: "b", host: "b"})
+
+	for _, want := range []string{"a", "b"} {
+		select {
+		case host := <-started:
+			if host != want {
+				t.Fatalf("expect a job of %s started, got %s", want, host)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("a job of %s should start while the other host is at its cap", want)
+		}
+	}
+
+	close(release)
+	if parked := pool.close(); len(parked) != 2 {
+		t.Fatalf("the jobs never started should be given back, got %d", len(parked))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,105 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+)
+import (
+	xproxy "golang.org/x/net/proxy"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func supportedProxy(proxy *url.URL) bool {
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return true
+	}
+	return false
+}
+
+func isSocksProxy(proxy *url.URL) bool {
+	return proxy.Scheme == "socks5" || proxy.Scheme == "socks5h"
+}
+
+// socksDialContext dial through a SOCKS5 proxy, with the credentials of its url,
+// socks5 resolves the host names here while socks5h leaves it to the proxy
+func socksDialContext(proxy *url.URL) (dialFunc, error) {
+	var auth *xproxy.Auth
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth = &xproxy.Auth{User: proxy.User.Username(), Password: password}
+	}
+
+	d, err := xproxy.SOCKS5("tcp", proxy.Host, auth, nil)
+	if err != nil {
+		return nil, err
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return d.Dial(network, addr)
+	}
+	if cd, ok := d.(contextDialer); ok {
+		dial = cd.DialContext
+	}
+	if proxy.Scheme == "socks5h" {
+		return dial, nil
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		var ips []net.IPAddr
+		if ips, err = net.DefaultResolver.LookupIPAddr(ctx, host); err != nil {
+			return nil, err
+		}
+		if len(ips) < 1 {
+			return nil, errors.New("no address of " + host)
+		}
+		// the IPv4 ones first, not every proxy reaches IPv6, then one after another until one is reached
+		sort.SliceStable(ips, func(i, j int) bool {
+			return ips[i].IP.To4() != nil && ips[j].IP.To4() == nil
+		})
+		var conn net.Conn
+		for _, ip := range ips {
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip.IP.String(), port)); err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+		return conn, err
+	}, nil
+}
+
+// proxyAuthTransport sends the Proxy-Authorization of the task to a http proxy, the plain http requests carry it
+// themselves, while for https it is in the CONNECT request only, see ProxyConnectHeader, so it never reaches the origin
+type proxyAuthTransport struct {
+	*http.Transport
+	auth string
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return t.Transport.RoundTrip(req)
+	}
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Proxy-Authorization", t.auth)
+	return t.Transport.RoundTrip(r)
+}
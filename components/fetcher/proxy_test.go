@@ -0,0 +1,252 @@
+package fetcher
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+// socks5Server is a SOCKS5 stand-in, CONNECT only, it records the addresses asked for
+// and tunnels every one of them to target
+type socks5Server struct {
+	net.Listener
+	user, password string
+	target         string
+
+	sync.Mutex
+	asked []string // "domain host:port" or "ip host:port"
+}
+
+func newSocks5Server(t *testing.T, target, user, password string) *socks5Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5Server{Listener: l, user: user, password: password, target: target}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return s
+}
+
+func (s *socks5Server) handle(c net.Conn) {
+	defer func() { _ = c.Close() }()
+	r := bufio.NewReader(c)
+
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil || head[0] != 5 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	method := byte(0)
+	if s.user != "" {
+		method = 2
+	}
+	if !strings.Contains(string(methods), string([]byte{method})) {
+		_, _ = c.Write([]byte{5, 0xff})
+		return
+	}
+	_, _ = c.Write([]byte{5, method})
+
+	if method == 2 {
+		readString := func() string {
+			n, _ := r.ReadByte()
+			b := make([]byte, n)
+			_, _ = io.ReadFull(r, b)
+			return string(b)
+		}
+		_, _ = r.ReadByte() // version
+		if user, password := readString(), readString(); user != s.user || password != s.password {
+			_, _ = c.Write([]byte{1, 1})
+			return
+		}
+		_, _ = c.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil || req[1] != 1 {
+		return
+	}
+	var kind, host string
+	switch req[3] {
+	case 1, 4:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == 4 {
+			ip = make([]byte, net.IPv6len)
+		}
+		_, _ = io.ReadFull(r, ip)
+		kind, host = "ip", net.IP(ip).String()
+	case 3:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		_, _ = io.ReadFull(r, name)
+		kind, host = "domain", string(name)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return
+	}
+	s.Lock()
+	s.asked = append(s.asked, kind+" "+net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	s.Unlock()
+
+	up, err := net.Dial("tcp", s.target)
+	if err != nil {
+		_, _ = c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer func() { _ = up.Close() }()
+	_, _ = c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go func() { _, _ = io.Copy(up, r) }()
+	_, _ = io.Copy(c, up)
+}
+
+func (s *socks5Server) lastAsked() string {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.asked) == 0 {
+		return ""
+	}
+	return s.asked[len(s.asked)-1]
+}
+
+// connectProxy is a http proxy stand-in, it wants the Proxy-Authorization auth, and answers the plain
+// http requests itself, while CONNECT is tunneled to the host asked for
+func connectProxy(auth string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != http.MethodConnect {
+			_, _ = fmt.Fprintf(w, "proxied %v", r.URL.Host)
+			return
+		}
+		up, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		c, buf, _ := w.(http.Hijacker).Hijack()
+		_, _ = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(up, buf)
+			_ = up.Close()
+		}()
+		_, _ = io.Copy(c, up)
+		_ = c.Close()
+	}))
+}
+
+func fetchThrough(url, proxy string, headers map[string]string) *core.Response {
+	task := newTask(url, nil)
+	task.Fetch.Proxy = proxy
+	task.Fetch.Headers = headers
+	return fetchTask(task)
+}
+
+func TestFetcherSocks5Proxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "hello %v", r.Host)
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	socks := newSocks5Server(t, origin.Listener.Addr().String(), "", "")
+	defer func() { _ = socks.Close() }()
+
+	// socks5 resolves the host here, the proxy is given an ip
+	resp := fetchThrough("http://localhost:"+port+"/", "socks5://"+socks.Addr().String(), nil)
+	if resp.StatusCode != 200 || string(resp.Content) != "hello localhost:"+port {
+		t.Fatalf("should fetch through socks5, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Content)
+	}
+	if asked := socks.lastAsked(); asked != "ip 127.0.0.1:"+port {
+		t.Fatalf("socks5 should ask for an ip, IPv4 first, asked %q", asked)
+	}
+
+	// socks5h leaves it to the proxy, the name does not resolve here
+	resp = fetchThrough("http://spider.invalid:"+port+"/", "socks5h://"+socks.Addr().String(), nil)
+	if resp.StatusCode != 200 || string(resp.Content) != "hello spider.invalid:"+port {
+		t.Fatalf("should fetch through socks5h, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Content)
+	}
+	if asked := socks.lastAsked(); asked != "domain spider.invalid:"+port {
+		t.Fatalf("socks5h should ask for the domain, asked %q", asked)
+	}
+}
+
+func TestFetcherSocks5ProxyAuth(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "ok")
+	}))
+	defer origin.Close()
+
+	socks := newSocks5Server(t, origin.Listener.Addr().String(), "spider", "secret")
+	defer func() { _ = socks.Close() }()
+
+	resp := fetchThrough("http://spider.invalid/", "socks5h://spider:secret@"+socks.Addr().String(), nil)
+	if resp.StatusCode != 200 || string(resp.Content) != "ok" {
+		t.Fatalf("should authenticate to the proxy, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+	if strings.Contains(resp.Proxy, "secret") {
+		t.Fatalf("proxy password should be redacted, got %v", resp.Proxy)
+	}
+
+	resp = fetchThrough("http://spider.invalid/", "socks5h://spider:wrong@"+socks.Addr().String(), nil)
+	if resp.StatusCode != core.StatusFetchError {
+		t.Fatalf("should fail with a wrong password, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+}
+
+func TestFetcherProxyAuthorization(t *testing.T) {
+	const auth = "Basic c3BpZGVyOnNlY3JldA=="
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "origin saw %q", r.Header.Get("Proxy-Authorization"))
+	}))
+	defer origin.Close()
+	proxy := connectProxy(auth)
+	defer proxy.Close()
+
+	headers := map[string]string{"Proxy-Authorization": auth}
+
+	// https: in the CONNECT request, never to the origin
+	task := newTask(origin.URL, nil)
+	task.Fetch.Proxy, task.Fetch.Headers = proxy.URL, headers
+	task.Fetch.TLS = &core.TLSConfig{Insecure: true}
+	resp := fetchTask(task)
+	if resp.StatusCode != 200 || string(resp.Content) != `origin saw ""` {
+		t.Fatalf("should tunnel with the auth, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Content)
+	}
+
+	// http: with the request, which goes to the proxy
+	resp = fetchThrough("http://spider.invalid/", proxy.URL, headers)
+	if resp.StatusCode != 200 || string(resp.Content) != "proxied spider.invalid" {
+		t.Fatalf("should send the auth to the proxy, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Content)
+	}
+
+	task.Fetch.Headers = nil
+	resp = fetchTask(task)
+	if resp.StatusCode == 200 {
+		t.Fatalf("should be refused without the auth, got %v %q", resp.StatusCode, resp.Content)
+	}
+}
@@ -0,0 +1,54 @@
+package fetcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestFetcherRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+		case "/home":
+			http.Redirect(w, r, "/final", http.StatusMovedPermanently)
+		default:
+			_, _ = w.Write([]byte("final"))
+		}
+	}))
+	defer server.Close()
+
+	resp := fetchTask(newTask(server.URL+"/login", nil))
+	if resp.StatusCode != 200 || resp.Url != server.URL+"/final" || len(resp.Redirects) != 2 {
+		t.Fatalf("should follow the redirects, got %v %v %+v", resp.StatusCode, resp.Url, resp.Redirects)
+	}
+	first, second := resp.Redirects[0], resp.Redirects[1]
+	if first.Url != server.URL+"/login" || first.StatusCode != http.StatusFound || first.Headers.Get("Set-Cookie") != "session=1" {
+		t.Fatalf("should keep the first hop, got %+v", first)
+	}
+	if second.Url != server.URL+"/home" || second.StatusCode != http.StatusMovedPermanently || second.Headers.Get("Location") != "/final" {
+		t.Fatalf("should keep the second hop, got %+v", second)
+	}
+
+	task := newTask(server.URL+"/login", nil)
+	task.Fetch.StopAtRedirect = true
+	resp = fetchTask(task)
+	if resp.StatusCode != http.StatusFound || resp.ErrMessage != "" || resp.Headers.Get("Location") != "/home" {
+		t.Fatalf("should return the redirect itself, got %v %v %v", resp.StatusCode, resp.ErrMessage, resp.Headers)
+	}
+	if len(resp.Redirects) != 0 || resp.Cookies["session"] != "1" || resp.Url != server.URL+"/login" {
+		t.Fatalf("should stop at the first response, got %+v %v %v", resp.Redirects, resp.Cookies, resp.Url)
+	}
+
+	task = newTask(server.URL+"/login", nil)
+	task.Fetch.MaxRedirects = 1
+	if resp = fetchTask(task); resp.StatusCode != core.StatusRedirectError || len(resp.Redirects) != 1 {
+		t.Fatalf("should keep the hops of too many redirects, got %v %+v", resp.StatusCode, resp.Redirects)
+	}
+}
@@ -0,0 +1,102 @@
+package fetcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+const formContentType = "application/x-www-form-urlencoded"
+
+var httpMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true, "TRACE": true,
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// requestBody returns the body of a task and its content type, a nil body when there is none
+func requestBody(fetch *core.TaskFetcher) ([]byte, string, error) {
+	var kinds int
+	for _, has := range []bool{fetch.Data != "", len(fetch.BinaryData) > 0, len(fetch.Json) > 0,
+		len(fetch.Form) > 0 || len(fetch.Files) > 0} {
+		if has {
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		return nil, "", errors.New("only one of data, binary_data, json and form/files can be the body")
+	}
+
+	switch {
+	case len(fetch.Files) > 0:
+		return multipartBody(fetch.Form, fetch.Files)
+	case len(fetch.Form) > 0:
+		values := url.Values{}
+		for k, v := range fetch.Form {
+			values.Set(k, v)
+		}
+		return []byte(values.Encode()), formContentType, nil
+	case len(fetch.Json) > 0:
+		if !json.Valid(fetch.Json) {
+			return nil, "", errors.New("invalid json body")
+		}
+		return fetch.Json, "application/json", nil
+	case len(fetch.BinaryData) > 0:
+		return fetch.BinaryData, "application/octet-stream", nil
+	case fetch.Data != "":
+		return []byte(fetch.Data), formContentType, nil
+	}
+	return nil, "", nil
+}
+
+func multipartBody(form map[string]string, files []core.FormFile) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+
+	names := make([]string, 0, len(form))
+	for name := range form {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := w.WriteField(name, form[name]); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for _, file := range files {
+		if file.Field == "" {
+			return nil, "", fmt.Errorf("no field of file %v", file.FileName)
+		}
+		contentType := file.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			quoteEscaper.Replace(file.Field), quoteEscaper.Replace(file.FileName)))
+		header.Set("Content-Type", contentType)
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err = part.Write(file.Content); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
@@ -0,0 +1,65 @@
+package fetcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestFetcherMethodsAndBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			f, header, err := r.FormFile("upload")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			content, _ := ioutil.ReadAll(f)
+			_, _ = fmt.Fprintf(w, "%s %v %v %v %s", r.Method, r.FormValue("name"), header.Filename,
+				header.Header.Get("Content-Type"), content)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s %v %q", r.Method, r.Header.Get("Content-Type"), body)
+	}))
+	defer server.Close()
+
+	fetch := func(kwArgs map[string]interface{}) *core.Response {
+		return fetchTask(newTask(server.URL+"/", kwArgs))
+	}
+	cases := []struct {
+		kwArgs map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"method": "delete"}, `DELETE  ""`},
+		{map[string]interface{}{"method": "OPTIONS"}, `OPTIONS  ""`},
+		{map[string]interface{}{"method": "PATCH", "data": "a=1"}, `PATCH application/x-www-form-urlencoded "a=1"`},
+		{map[string]interface{}{"method": "PUT", "binary_data": []byte{0, 0xff}}, `PUT application/octet-stream "\x00\xff"`},
+		{map[string]interface{}{"json": []int{1, 2}}, `POST application/json "[1,2]"`},
+		{map[string]interface{}{"json": 1, "headers": map[string]string{"Content-Type": "application/vnd.api+json"}},
+			`POST application/vnd.api+json "1"`},
+		{map[string]interface{}{"form": map[string]string{"a": "1 2"}}, `POST application/x-www-form-urlencoded "a=1+2"`},
+		{map[string]interface{}{"form": map[string]string{"name": "spider"},
+			"files": []core.FormFile{{Field: "upload", FileName: "a.txt", ContentType: "text/plain", Content: []byte("hello")}}},
+			"POST spider a.txt text/plain hello"},
+	}
+	for _, c := range cases {
+		if resp := fetch(c.kwArgs); resp.StatusCode != 200 || string(resp.Content) != c.want {
+			t.Fatalf("%v should send %v, got %v %v %s", c.kwArgs, c.want, resp.StatusCode, resp.ErrMessage, resp.Content)
+		}
+	}
+
+	if resp := fetch(map[string]interface{}{"method": "BREW"}); resp.StatusCode != core.StatusInvalidTask {
+		t.Fatalf("should refuse an unknown method, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+	if resp := fetch(map[string]interface{}{"data": "a=1", "json": 1}); resp.StatusCode != core.StatusInvalidTask {
+		t.Fatalf("should refuse two bodies, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+}
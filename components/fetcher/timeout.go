@@ -0,0 +1,113 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+import (
+	"github.com/xgo11/spider/core"
+)
+
+const (
+	timeoutConnect = "connect"
+	timeoutTLS     = "tls handshake"
+	timeoutHeader  = "response header"
+	timeoutTotal   = "total"
+)
+
+var timeoutStatus = map[string]int{
+	timeoutConnect: core.StatusConnectTimeout,
+	timeoutTLS:     core.StatusTLSTimeout,
+	timeoutHeader:  core.StatusHeaderTimeout,
+	timeoutTotal:   core.StatusTotalTimeout,
+}
+
+// fetchTimer bounds one request, every phase followed by httptrace has its own timer,
+// and the total one keeps running while the body is read, until stop
+type fetchTimer struct {
+	sync.Mutex
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	total   *time.Timer
+	phase   *time.Timer
+	expired string // the timeout which cancelled the request
+}
+
+func newFetchTimer(param *clientParams) *fetchTimer {
+	t := &fetchTimer{}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	total := param.readTimeout
+	if !param.deadline.IsZero() { // the tries before took their part of it
+		if left := time.Until(param.deadline); left < total {
+			total = left
+		}
+	}
+	t.total = time.AfterFunc(total, func() { t.expire(timeoutTotal) })
+
+	t.ctx = httptrace.WithClientTrace(t.ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			t.startPhase(timeoutConnect, param.connectTimeout)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.stopPhase()
+		},
+		TLSHandshakeStart: func() {
+			t.startPhase(timeoutTLS, param.tlsTimeout)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.stopPhase()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.startPhase(timeoutHeader, param.headerTimeout)
+		},
+		GotFirstResponseByte: func() {
+			t.stopPhase()
+		},
+	})
+	return t
+}
+
+func (t *fetchTimer) startPhase(name string, timeout time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	if t.phase != nil {
+		t.phase.Stop()
+	}
+	t.phase = time.AfterFunc(timeout, func() { t.expire(name) })
+}
+
+func (t *fetchTimer) stopPhase() {
+	t.Lock()
+	defer t.Unlock()
+	if t.phase != nil {
+		t.phase.Stop()
+		t.phase = nil
+	}
+}
+
+func (t *fetchTimer) expire(name string) {
+	t.Lock()
+	if t.expired == "" {
+		t.expired = name
+	}
+	t.Unlock()
+	t.cancel()
+}
+
+// expiredTimeout tells which timeout cancelled the request, empty when none did
+func (t *fetchTimer) expiredTimeout() string {
+	t.Lock()
+	defer t.Unlock()
+	return t.expired
+}
+
+// stop release the request, it must be called once the body is read
+func (t *fetchTimer) stop() {
+	t.total.Stop()
+	t.stopPhase()
+	t.cancel()
+}
@@ -0,0 +1,102 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+// fetchTrace records the phases of a try, its trace is composed with the one of fetchTimer
+type fetchTrace struct {
+	sync.Mutex
+
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wrote        time.Time
+	timing       core.FetchTiming
+}
+
+func newFetchTrace() *fetchTrace {
+	return &fetchTrace{start: time.Now()}
+}
+
+func sinceMS(t time.Time) int {
+	if t.IsZero() {
+		return 0
+	}
+	return int(time.Since(t) / time.Millisecond)
+}
+
+func (ft *fetchTrace) context(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			ft.Lock()
+			ft.dnsStart = time.Now()
+			ft.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			ft.Lock()
+			ft.timing.DNSMS += sinceMS(ft.dnsStart)
+			ft.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			ft.Lock()
+			ft.connectStart = time.Now()
+			ft.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			ft.Lock()
+			ft.timing.ConnectMS += sinceMS(ft.connectStart)
+			ft.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			ft.Lock()
+			ft.tlsStart = time.Now()
+			ft.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			ft.Lock()
+			ft.timing.TLSMS += sinceMS(ft.tlsStart)
+			ft.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			ft.Lock()
+			ft.timing.Reused = info.Reused
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				ft.timing.RemoteIP = host
+			}
+			ft.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			ft.Lock()
+			ft.wrote = time.Now()
+			ft.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			ft.Lock()
+			ft.timing.ServerMS += sinceMS(ft.wrote)
+			ft.timing.FirstByteMS = sinceMS(ft.start)
+			ft.Unlock()
+		},
+	})
+}
+
+// result returns the timing of the try, once the body is read
+func (ft *fetchTrace) result(proto string, attempts int) *core.FetchTiming {
+	ft.Lock()
+	defer ft.Unlock()
+	timing := ft.timing
+	timing.TotalMS = sinceMS(ft.start)
+	timing.Proto = proto
+	timing.Attempts = attempts
+	return &timing
+}
@@ -0,0 +1,48 @@
+package fetcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestFetcherTiming(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	var hookTimings []*core.FetchTiming
+	f := newTestFetcher(core.FetcherHook{
+		Hook:     core.Hook{Name: "timing"},
+		AfterReq: func(task *core.Task, resp *core.Response) { hookTimings = append(hookTimings, resp.Timing) },
+	})
+	fetch := func(path string) *core.Response {
+		task := newTask(server.URL+path, nil)
+		task.Fetch.TLS = &core.TLSConfig{Insecure: true}
+		return f.fetch(task)
+	}
+
+	resp := fetch("/slow")
+	timing := resp.Timing
+	if timing == nil || timing.RemoteIP != "127.0.0.1" || timing.Proto != "HTTP/1.1" || timing.Reused || timing.Attempts != 1 {
+		t.Fatalf("should trace the request, got %+v", timing)
+	}
+	if timing.ServerMS < 50 || timing.FirstByteMS < timing.ServerMS || timing.TotalMS < timing.FirstByteMS {
+		t.Fatalf("should time the server, got %+v", timing)
+	}
+	if resp = fetch("/"); resp.Timing == nil || !resp.Timing.Reused || resp.Timing.TLSMS != 0 || resp.Timing.ServerMS >= 50 {
+		t.Fatalf("should reuse the connection, got %+v", resp.Timing)
+	}
+	if len(hookTimings) != 2 || !hookTimings[1].Reused {
+		t.Fatalf("hooks should see the timing, got %+v", hookTimings)
+	}
+}
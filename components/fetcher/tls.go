@@ -0,0 +1,79 @@
+package fetcher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// buildTLSConfig load the files of conf, nil for the zero conf, which is the default of the transport
+func buildTLSConfig(conf core.TLSConfig) (*tls.Config, error) {
+	if conf == (core.TLSConfig{}) {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: conf.Insecure, ServerName: conf.ServerName}
+	if conf.MinVersion != "" {
+		version, ok := tlsVersions[conf.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %v", conf.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in " + conf.CAFile)
+		}
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// isTLSError tells whether a request failed in the TLS handshake, the certificate of the server
+// is not trusted or the server refused the handshake; trying again would fail the same way
+func isTLSError(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, x509.SystemRootsError,
+			x509.ConstraintViolationError, x509.UnhandledCriticalExtension, tls.RecordHeaderError:
+			return true
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			// the alerts sent by the server are of an unexported type
+			return reflect.TypeOf(err).PkgPath() == "crypto/tls"
+		}
+	}
+	return false
+}
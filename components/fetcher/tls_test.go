@@ -0,0 +1,140 @@
+package fetcher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestIsTLSError(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, err := http.Get(server.URL)
+	if err == nil || !isTLSError(err) {
+		t.Fatalf("an untrusted certificate should be a tls error, got %v", err)
+	}
+	server.Close()
+	if _, err = http.Get(server.URL); err == nil || isTLSError(err) {
+		t.Fatalf("a refused connection should not be a tls error, got %v", err)
+	}
+	if isTLSError(errors.New("tls: but only the text")) {
+		t.Fatalf("errors are told by their type, not their text")
+	}
+}
+
+func TestTransportCacheKeepsTLSConfig(t *testing.T) {
+	tc := newTransportCache(core.TransportConfig{})
+	conf := core.TLSConfig{Insecure: true, MinVersion: "1.2"}
+
+	first, err := tc.tlsConfig(conf)
+	if err != nil || first == nil {
+		t.Fatalf("should build the config, got %v", err)
+	}
+	if again, _ := tc.tlsConfig(conf); again != first {
+		t.Fatalf("the config should be built once")
+	}
+	if _, err = tc.tlsConfig(core.TLSConfig{CAFile: "/not/exists"}); err == nil {
+		t.Fatalf("a missing file should fail")
+	}
+	if len(tc.tlsConfigs) != 1 {
+		t.Fatalf("a failed config should not be kept, got %d", len(tc.tlsConfigs))
+	}
+}
+
+// writePEM write the certificate and the key of server, for the TLS configs to load
+func writePEM(t *testing.T, dir string, server *httptest.Server) (certFile, keyFile string) {
+	cert := server.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	return
+}
+
+func TestFetcherTLSVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "hello %v", r.TLS.ServerName)
+	}))
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	caFile, _ := writePEM(t, dir, server)
+
+	fetch := func(url string, conf *core.TLSConfig) *core.Response {
+		task := newTask(url, nil)
+		task.Fetch.TLS = conf
+		return fetchTask(task)
+	}
+
+	// verified by default, the test certificate is not trusted
+	resp := fetch(server.URL, nil)
+	if resp.StatusCode != core.StatusTLSError || !strings.Contains(resp.ErrMessage, "tls handshake failed") {
+		t.Fatalf("should fail to verify, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+
+	if resp = fetch(server.URL, &core.TLSConfig{CAFile: caFile}); resp.StatusCode != 200 {
+		t.Fatalf("should verify with the ca file, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+	if resp = fetch(server.URL, &core.TLSConfig{Insecure: true}); resp.StatusCode != 200 {
+		t.Fatalf("should skip verifying, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+
+	// the test certificate is for example.com, not localhost
+	local := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if resp = fetch(local, &core.TLSConfig{CAFile: caFile}); resp.StatusCode != core.StatusTLSError {
+		t.Fatalf("should fail to verify localhost, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+	resp = fetch(local, &core.TLSConfig{CAFile: caFile, ServerName: "example.com"})
+	if resp.StatusCode != 200 || string(resp.Content) != "hello example.com" {
+		t.Fatalf("should send and verify the server name, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Content)
+	}
+
+	if resp = fetch(server.URL, &core.TLSConfig{CAFile: filepath.Join(dir, "none.pem")}); resp.StatusCode != core.StatusInvalidTask {
+		t.Fatalf("should refuse a missing ca file, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+	if resp = fetch(server.URL, &core.TLSConfig{Insecure: true, MinVersion: "2.0"}); resp.StatusCode != core.StatusInvalidTask {
+		t.Fatalf("should refuse an unknown version, got %v %v", resp.StatusCode, resp.ErrMessage)
+	}
+}
+
+func TestFetcherTLSClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%v certificates", len(r.TLS.PeerCertificates))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writePEM(t, dir, server)
+
+	task := newTask(server.URL, nil)
+	task.Fetch.TLS = &core.TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2"}
+	resp := fetchTask(task)
+	if resp.StatusCode != 200 || string(resp.Content) != "1 certificates" {
+		t.Fatalf("should present the client certificate, got %v %v %q", resp.StatusCode, resp.ErrMessage, resp.Content)
+	}
+
+	task = newTask(server.URL, nil)
+	task.Fetch.TLS = &core.TLSConfig{Insecure: true}
+	if resp = fetchTask(task); resp.StatusCode == 200 {
+		t.Fatalf("should fail without a client certificate, got %v %q", resp.StatusCode, resp.Content)
+	}
+}
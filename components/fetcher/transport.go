@@ -0,0 +1,165 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+import (
+	"github.com/xgo11/spider/core"
+)
+
+const (
+	defaultMaxIdleConns        = 256
+	defaultMaxIdleConnsPerHost = 16
+	defaultIdleConnTimeout     = 90 * time.Second
+	maxCachedTransports        = 256 // least recently used ones are closed beyond it
+)
+
+// transportKey is what makes two requests unable to share a transport
+type transportKey struct {
+	proxy     string
+	proxyAuth string
+	https     bool
+	tls       core.TLSConfig
+}
+
+type cachedTransport struct {
+	transport    *http.Transport
+	roundTripper http.RoundTripper // the transport, wrapped when needed
+	lastUsed     time.Time
+}
+
+// transportCache keeps one transport per proxy and TLS config, so the connections are pooled
+// among the tasks, while every task still gets its own http.Client with its own jar and redirect policy
+type transportCache struct {
+	sync.Mutex
+
+	conf       core.TransportConfig
+	transports map[transportKey]*cachedTransport
+	tlsConfigs map[core.TLSConfig]*tls.Config // built once, the files of a config are not read again
+}
+
+func newTransportCache(conf core.TransportConfig) *transportCache {
+	if conf.MaxIdleConns <= 0 {
+		conf.MaxIdleConns = defaultMaxIdleConns
+	}
+	if conf.MaxIdleConnsPerHost <= 0 {
+		conf.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if conf.IdleConnTimeout <= 0 {
+		conf.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	return &transportCache{
+		conf:       conf,
+		transports: map[transportKey]*cachedTransport{},
+		tlsConfigs: map[core.TLSConfig]*tls.Config{},
+	}
+}
+
+// tlsConfig returns the built conf, a failed build is not kept so a fixed file is read on the next request
+func (tc *transportCache) tlsConfig(conf core.TLSConfig) (*tls.Config, error) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if config, ok := tc.tlsConfigs[conf]; ok {
+		return config, nil
+	}
+	config, err := buildTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	if len(tc.tlsConfigs) >= maxCachedTransports {
+		tc.tlsConfigs = map[core.TLSConfig]*tls.Config{}
+	}
+	tc.tlsConfigs[conf] = config
+	return config, nil
+}
+
+func (tc *transportCache) get(param *clientParams) http.RoundTripper {
+	key := transportKey{https: param.url.Scheme == "https", tls: param.tls}
+	if param.proxy != nil {
+		key.proxy = param.proxy.String()
+		if !isSocksProxy(param.proxy) {
+			key.proxyAuth = param.proxyAuth
+		}
+	}
+
+	tc.Lock()
+	defer tc.Unlock()
+
+	if ct, ok := tc.transports[key]; ok {
+		ct.lastUsed = time.Now()
+		return ct.roundTripper
+	}
+
+	if len(tc.transports) >= maxCachedTransports {
+		tc.evictLocked()
+	}
+	ct := &cachedTransport{transport: tc.build(key, param), lastUsed: time.Now()}
+	ct.roundTripper = ct.transport
+	if key.proxyAuth != "" {
+		ct.roundTripper = &proxyAuthTransport{Transport: ct.transport, auth: key.proxyAuth}
+	}
+	tc.transports[key] = ct
+	return ct.roundTripper
+}
+
+func (tc *transportCache) build(key transportKey, param *clientParams) *http.Transport {
+	transport := &http.Transport{
+		// the timeouts are per request, see fetchTimer
+		DialContext:         (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        tc.conf.MaxIdleConns,
+		MaxIdleConnsPerHost: tc.conf.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     tc.conf.MaxConnsPerHost,
+		IdleConnTimeout:     tc.conf.IdleConnTimeout,
+		TLSClientConfig:     param.tlsConfig, // for the redirects to https as well
+	}
+	if param.proxy != nil {
+		if isSocksProxy(param.proxy) {
+			dial, err := socksDialContext(param.proxy)
+			if err != nil { // every request through it fails with err
+				dial = func(context.Context, string, string) (net.Conn, error) {
+					return nil, err
+				}
+			}
+			transport.DialContext = dial
+		} else {
+			transport.Proxy = http.ProxyURL(param.proxy)
+			if key.proxyAuth != "" {
+				transport.ProxyConnectHeader = http.Header{"Proxy-Authorization": {key.proxyAuth}}
+			}
+		}
+	}
+	if key.https {
+		transport.DisableCompression = true
+	}
+	return transport
+}
+
+// evictLocked close the least recently used transport
+func (tc *transportCache) evictLocked() {
+	var oldest transportKey
+	var oldestTime time.Time
+	for key, ct := range tc.transports {
+		if oldestTime.IsZero() || ct.lastUsed.Before(oldestTime) {
+			oldest, oldestTime = key, ct.lastUsed
+		}
+	}
+	if ct, ok := tc.transports[oldest]; ok {
+		ct.transport.CloseIdleConnections()
+		delete(tc.transports, oldest)
+	}
+}
+
+// closeIdle close the idle connections of all the transports
+func (tc *transportCache) closeIdle() {
+	tc.Lock()
+	defer tc.Unlock()
+	for _, ct := range tc.transports {
+		ct.transport.CloseIdleConnections()
+	}
+}
@@ -3,6 +3,7 @@ package processor
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sync"
@@ -11,6 +12,8 @@ import (
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/xgo11/datetime"
 	"github.com/xgo11/spider/common"
 	"github.com/xgo11/spider/core"
 )
@@ -22,6 +25,7 @@ type basicProcessor struct {
 	fetcher2ProcessQ core.IQueue
 	process2ResultQ  core.IQueue
 	statusQ          core.IQueue
+	inbox            *core.Inbox
 	pause            bool
 	isRunning        bool
 	wg               *sync.WaitGroup
@@ -30,6 +34,8 @@ type basicProcessor struct {
 
 var (
 	logger = common.GetLogger("processor")
+
+	_ core.IDeadLetterRouter = &basicProcessor{}
 )
 
 func NewProcessor(newQ, f2pQ, p2rQ, sQ core.IQueue, hooks ...core.ProcessHook) core.IProcessor {
@@ -38,6 +44,7 @@ func NewProcessor(newQ, f2pQ, p2rQ, sQ core.IQueue, hooks ...core.ProcessHook) c
 	p.fetcher2ProcessQ = f2pQ
 	p.process2ResultQ = p2rQ
 	p.statusQ = sQ
+	p.inbox = &core.Inbox{Stage: core.StageProcessor, Queue: f2pQ, Logger: logger}
 	p.pause = false
 	p.isRunning = false
 	p.wg = &sync.WaitGroup{}
@@ -62,6 +69,12 @@ func (p *basicProcessor) Shutdown() {
 	logger.Info("safe shutdown")
 }
 
+func (p *basicProcessor) SetDeadLetterQueue(q core.IQueue) {
+	p.Lock()
+	defer p.Unlock()
+	p.inbox.DeadQ = q
+}
+
 func (p *basicProcessor) HttpServe() http.HandlerFunc {
 	engine := gin.Default()
 	engine.GET("/", func(context *gin.Context) {
@@ -110,6 +123,12 @@ func (p *basicProcessor) HttpServe() http.HandlerFunc {
 	return engine.ServeHTTP
 }
 
+func (p *basicProcessor) paused() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.pause
+}
+
 func (p *basicProcessor) Run() {
 	p.Lock()
 	if p.isRunning {
@@ -121,21 +140,47 @@ func (p *basicProcessor) Run() {
 	p.Unlock()
 
 	var sleepIdle = 1000 * time.Millisecond
+	var receiveTimeout = time.Second
+	var requeueInterval = 30 * time.Second
+	var lastRequeue = time.Now()
+
+	// the run loop is counted too, so Shutdown can not miss a message it hands over
+	p.wg.Add(1)
+	defer p.wg.Done()
 
 	logger.Info("start running ... ")
 
-	for !p.pause {
-		messages := p.fetcher2ProcessQ.Pop(1)
-		if len(messages) < 1 && !p.pause {
+	for !p.paused() {
+		if time.Since(lastRequeue) >= requeueInterval {
+			if cnt := core.Requeue(p.fetcher2ProcessQ); cnt > 0 {
+				logger.WithField("count", cnt).Warn("requeue expired messages")
+			}
+			lastRequeue = time.Now()
+		}
+
+		// newTaskQ is not waited for, the scheduler feeding the fetchers which feed us drains it,
+		// and a full one only slows down handing the new tasks over, see core.HandOffStop
+		if core.IsCongested(p.process2ResultQ) { // let the result workers catch up
+			logger.WithField("queue", p.process2ResultQ.Name()).Debug("downstream congested")
 			time.Sleep(sleepIdle)
+			continue
 		}
+
+		messages := core.Receive(p.fetcher2ProcessQ, 1, receiveTimeout)
 		for _, msg := range messages {
+			if core.Attempts(p.fetcher2ProcessQ, msg) > core.MaxDeliveryAttempts {
+				logger.Warn("too many attempts")
+				p.inbox.Dead(msg, core.DeadReasonRetryExceeded, nil)
+				continue
+			}
 			body := core.Fetch2ProcessMessage{}
 			if err := json.Unmarshal([]byte(msg), &body); err != nil || body.Task == nil || body.Response == nil {
 				logger.WithError(err).Warn("invalid message")
+				p.inbox.Dead(msg, core.DeadReasonInvalidMessage, err)
 				continue
 			}
-			go p.processOne(body.Task, body.Response)
+			p.wg.Add(1)
+			go p.processOne(msg, body.Task, body.Response)
 		}
 	}
 
@@ -145,46 +190,163 @@ func (p *basicProcessor) Run() {
 	logger.Info("stopped run")
 }
 
-func (p *basicProcessor) processOne(task *core.Task, resp *core.Response) {
-	p.wg.Add(1)
+func (p *basicProcessor) processOne(msg string, task *core.Task, resp *core.Response) {
 	defer p.wg.Done()
 
+	stop := core.HandOffStop(p.paused)
 	projectName := task.Project
 	project, exists := core.GetProjectManager().Get(projectName)
 
 	if !exists {
 		logger.WithField("project", projectName).Warnf("project not exists")
+		p.inbox.Dead(msg, core.DeadReasonNoProject, nil)
+		p.sendStatus(task, core.TaskStatusFailed, fmt.Errorf("project %v not exists", projectName))
+		return
+	}
+
+	// the fetch failed but may go well later, crawl it again if the project asks for, otherwise
+	// the callback gets the failed response as it always did
+	schedule, retried := core.TaskRetrySchedule(task)
+	if retried && core.TransientFailure(resp.StatusCode) {
+		cause := resp.ErrMessage
+		if cause == "" {
+			cause = fmt.Sprintf("status %d", resp.StatusCode)
+		}
+		p.retry(msg, task, resp, schedule, errors.New(cause), stop)
 		return
 	}
 
 	// TODO add callback timeout feature
-	newTasks, result := project.ExecuteCallback(task.Process.Callback, task, resp)
+	newTasks, result, err := p.executeCallback(project, task, resp)
+	if err != nil {
+		logger.WithError(err).WithField("taskid", task.TaskId).WithField("callback", task.Process.Callback).Error("callback panic")
+		if retried {
+			p.retry(msg, task, resp, schedule, err, stop)
+		} else {
+			p.inbox.Dead(msg, core.DeadReasonPanic, err)
+			p.sendStatus(task, core.TaskStatusFailed, err)
+		}
+		return
+	}
 	task.Status = core.TaskStatusProcessed
 
 	if len(newTasks) > 0 { // send new tasks to scheduler
 		for _, tsk := range newTasks {
+			if tsk == nil {
+				continue
+			}
 			if tsk.Project == "" {
 				tsk.Project = projectName
 			}
 			if tsk.TaskId == "" {
 				tsk.TaskId = project.TaskId(tsk)
 			}
-			p.sendNewTask(tsk)
+			if e := p.sendNewTask(tsk, stop); e != nil {
+				err = e
+			}
 		}
 	}
 
-	if result != nil { // send result to result worker queue
-		p.sendResult(task, result)
+	if result != nil && err == nil { // send result to result worker queue
+		err = p.sendResult(task, result, stop)
 	}
+
+	// ack only when everything is handed downstream, otherwise let it be processed again
+	if err != nil {
+		p.inbox.GiveBack(msg, err)
+	} else {
+		p.processed(msg, resp)
+		p.sendStatus(task, core.TaskStatusProcessed, nil)
+	}
+}
+
+func (p *basicProcessor) sendStatus(task *core.Task, status int, err error) {
+	if e := core.SendStatus(p.statusQ, core.StageProcessor, task, status, err); e != nil {
+		logger.WithError(e).WithField("taskid", task.TaskId).WithField("op", "sendStatus").Error("fail")
+	}
+}
+
+// executeCallback run the project callback, a panic is recovered and returned as error
+func (p *basicProcessor) executeCallback(project core.IProject, task *core.Task, resp *core.Response) (newTasks []*core.Task, result *core.Result, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	newTasks, result = project.ExecuteCallback(task.Process.Callback, task, resp)
+	return
+}
+
+// retry send a failed task back to the scheduler, to be crawled again after the delay of schedule.
+// Out of retries the task is given up into the dead letter queue.
+func (p *basicProcessor) retry(msg string, task *core.Task, resp *core.Response, schedule core.RetrySchedule, cause error, stop func() bool) {
+	delay, ok := schedule.Next(task.Schedule.Retried)
+	if !ok {
+		p.giveUp(msg, task, resp, cause)
+		return
+	}
+
+	retryTask := *task
+	retryTask.Schedule.Retried++
+	retryTask.Schedule.ExecuteTime = datetime.NowUnix() + delay
+	retryTask.Schedule.Force = true // it is in the task store already
+	if err := p.sendNewTask(&retryTask, stop); err != nil {
+		p.inbox.GiveBack(msg, err)
+		return
+	}
+	p.processed(msg, resp)
+
+	logger.WithError(cause).WithFields(logrus.Fields{
+		"taskid": task.TaskId,
+		"retry":  retryTask.Schedule.Retried,
+		"delay":  delay,
+	}).Warn("retry later")
+	p.sendStatus(task, core.TaskStatusFailed, fmt.Errorf("retry %d in %ds: %v", retryTask.Schedule.Retried, delay, cause))
+}
+
+// giveUp record a task out of retries as a dead letter of newTaskQ, re-driving it starts over its retries.
+// Without a dead letter queue the task is logged, to be put into newTaskQ again by hand.
+func (p *basicProcessor) giveUp(msg string, task *core.Task, resp *core.Response, cause error) {
+	record := *task
+	record.Schedule.Retried = 0
+	record.Schedule.Force = true
+	bytes, err := json.Marshal(&record)
+	if err == nil && p.inbox.DeadQ != nil {
+		dl := core.NewDeadLetter(core.StageProcessor, p.newTaskQ, core.DeadReasonRetryExhausted, cause, string(bytes))
+		err = core.SendDeadLetter(p.inbox.DeadQ, dl)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("op", "deadLetter").Error("fail")
+		p.inbox.Nack(msg)
+		return
+	}
+	p.processed(msg, resp)
+
+	entry := logger.WithError(cause).WithField("taskid", task.TaskId).WithField("retried", task.Schedule.Retried)
+	if p.inbox.DeadQ == nil {
+		entry = entry.WithField("task", string(bytes))
+	}
+	entry.Error("give up")
+	p.sendStatus(task, core.TaskStatusFailed, cause)
 }
 
-func (p *basicProcessor) sendNewTask(task *core.Task) {
+// processed ack msg for good, the body of its response in the blob store is not needed any more.
+// A message given up as a dead letter keeps its blob, to be processed again when re-driven.
+func (p *basicProcessor) processed(msg string, resp *core.Response) {
+	p.inbox.Ack(msg)
+	if resp.Blob != "" {
+		if err := core.GetBlobStore().Delete(resp.Blob); err != nil {
+			logger.WithError(err).WithField("blob", resp.Blob).WithField("op", "deleteBlob").Error("fail")
+		}
+	}
+}
+
+func (p *basicProcessor) sendNewTask(task *core.Task, stop func() bool) (err error) {
 	if task != nil {
 		task.Status = core.TaskStatusInit
-		var err error
 		var tskBytes []byte
 		if tskBytes, err = json.Marshal(task); err == nil {
-			if err = p.newTaskQ.Put(string(tskBytes)); err == nil {
+			if err = core.PutWait(p.newTaskQ, stop, string(tskBytes)); err == nil {
 				p.onSendNewTask(task)
 			}
 		}
@@ -193,9 +355,10 @@ func (p *basicProcessor) sendNewTask(task *core.Task) {
 			logger.WithError(err).WithField("task_info", string(tskBytes)).WithField("op", "sendNewTask").Error("fail")
 		}
 	}
+	return
 }
 
-func (p *basicProcessor) sendResult(task *core.Task, ret *core.Result) {
+func (p *basicProcessor) sendResult(task *core.Task, ret *core.Result, stop func() bool) error {
 	msg := core.Process2ResultMessage{}
 	msg.Task = task
 	msg.Result = ret
@@ -204,7 +367,7 @@ func (p *basicProcessor) sendResult(task *core.Task, ret *core.Result) {
 	var err error
 
 	if msgBytes, err = json.Marshal(&msg); err == nil {
-		if err = p.process2ResultQ.Put(string(msgBytes)); err == nil {
+		if err = core.PutWait(p.process2ResultQ, stop, string(msgBytes)); err == nil {
 			p.onSendResult(task, ret)
 		}
 	}
@@ -212,6 +375,7 @@ func (p *basicProcessor) sendResult(task *core.Task, ret *core.Result) {
 		// TODO 兜底方案
 		logger.WithError(err).WithField("result", string(msgBytes)).WithField("op", "sendResult").Error("fail")
 	}
+	return err
 }
 
 func (p *basicProcessor) onSendNewTask(task *core.Task) {
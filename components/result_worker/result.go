@@ -2,6 +2,7 @@ package result_worker
 
 import (
 	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -14,6 +15,8 @@ import (
 
 var (
 	logger = common.GetLogger("result_worker")
+
+	_ core.IDeadLetterRouter = &basicResultWorker{}
 )
 
 type basicResultWorker struct {
@@ -21,6 +24,7 @@ type basicResultWorker struct {
 
 	process2ResultQ core.IQueue
 	statusQ         core.IQueue
+	inbox           *core.Inbox
 	wg              *sync.WaitGroup
 	hooks           []core.ResultWorkerHook
 	hooksCount      int
@@ -32,6 +36,7 @@ func NewResultWorker(p2rQ, sQ core.IQueue, hooks ...core.ResultWorkerHook) core.
 	r := &basicResultWorker{}
 	r.process2ResultQ = p2rQ
 	r.statusQ = sQ
+	r.inbox = &core.Inbox{Stage: core.StageResultWorker, Queue: p2rQ, Logger: logger}
 	r.wg = new(sync.WaitGroup)
 	r.pause = false
 	r.isRunning = false
@@ -58,6 +63,12 @@ func (r *basicResultWorker) Shutdown() {
 	logger.Info("safe shutdown")
 }
 
+func (r *basicResultWorker) SetDeadLetterQueue(q core.IQueue) {
+	r.Lock()
+	defer r.Unlock()
+	r.inbox.DeadQ = q
+}
+
 func (r *basicResultWorker) Run() {
 	r.Lock()
 	if r.isRunning {
@@ -68,18 +79,37 @@ func (r *basicResultWorker) Run() {
 	r.isRunning = true
 	r.Unlock()
 
+	// the run loop is counted too, so Shutdown can not miss a message it hands over
+	r.wg.Add(1)
+	defer r.wg.Done()
+
 	logger.Info("running ... ")
 
-	for !r.pause {
-		if messages := r.process2ResultQ.Pop(1); len(messages) < 1 {
-			time.Sleep(2 * time.Second)
+	var receiveTimeout = time.Second
+	var requeueInterval = 30 * time.Second
+	var lastRequeue = time.Now()
+
+	for !r.paused() {
+		if time.Since(lastRequeue) >= requeueInterval {
+			if cnt := core.Requeue(r.process2ResultQ); cnt > 0 {
+				logger.WithField("count", cnt).Warn("requeue expired messages")
+			}
+			lastRequeue = time.Now()
+		}
+
+		if messages := core.Receive(r.process2ResultQ, 1, receiveTimeout); len(messages) < 1 {
+			continue
+		} else if core.Attempts(r.process2ResultQ, messages[0]) > core.MaxDeliveryAttempts {
+			logger.WithField("body", messages[0]).WithField("op", "onResult").Error("too many attempts")
+			r.inbox.Dead(messages[0], core.DeadReasonRetryExceeded, nil)
 		} else {
 			body := core.Process2ResultMessage{}
 			if err := json.Unmarshal([]byte(messages[0]), &body); err == nil && body.Task != nil && body.Result != nil {
-				go r.onResult(body.Task, body.Result)
+				r.wg.Add(1)
+				go r.onResult(messages[0], body.Task, body.Result)
 			} else {
-				// TODO 降级方案
 				logger.WithError(err).WithField("body", messages[0]).WithField("op", "onResult").Error("fail")
+				r.inbox.Dead(messages[0], core.DeadReasonInvalidMessage, err)
 			}
 		}
 	}
@@ -90,7 +120,24 @@ func (r *basicResultWorker) Run() {
 	logger.Info("stopped run")
 }
 
-func (r *basicResultWorker) onResult(task *core.Task, ret *core.Result) {
+func (r *basicResultWorker) paused() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.pause
+}
+
+func (r *basicResultWorker) onResult(msg string, task *core.Task, ret *core.Result) {
+	defer r.wg.Done()
+
+	defer func() {
+		if e := recover(); e != nil {
+			logger.WithField("panic", e).WithField("taskid", task.TaskId).Error("result hook panic")
+			err := fmt.Errorf("%v", e)
+			r.inbox.Dead(msg, core.DeadReasonPanic, err)
+			r.sendStatus(task, core.TaskStatusFailed, err)
+		}
+	}()
+
 	task.Status = core.TaskStatusResulted
 	var projHooks []core.ResultWorkerHook
 	if proj, ok := core.GetProjectManager().Get(task.Project); ok {
@@ -119,4 +166,12 @@ func (r *basicResultWorker) onResult(task *core.Task, ret *core.Result) {
 		}
 	}
 
+	r.inbox.Ack(msg)
+	r.sendStatus(task, core.TaskStatusResulted, nil)
+}
+
+func (r *basicResultWorker) sendStatus(task *core.Task, status int, err error) {
+	if e := core.SendStatus(r.statusQ, core.StageResultWorker, task, status, err); e != nil {
+		logger.WithError(e).WithField("taskid", task.TaskId).WithField("op", "sendStatus").Error("fail")
+	}
 }
@@ -2,8 +2,11 @@ package scheduler
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,7 +24,14 @@ type basicScheduler struct {
 	newTaskQ           core.IQueue
 	scheduler2FetcherQ core.IQueue
 	statusQ            core.IQueue
+	inbox              *core.Inbox
+	delayStore         core.IDelayStore
+	taskStore          core.ITaskStore
+	rateLimiter        core.IRateLimiter
+	rateLimit          core.RateLimitConfig
 	hooks              []core.SchedulerHook
+	receiving          int32         // new tasks received but not yet parked or dispatched
+	done               chan struct{} // closed on shutdown
 	pause              bool
 	isRunning          bool
 	wg                 *sync.WaitGroup
@@ -29,6 +39,16 @@ type basicScheduler struct {
 
 var (
 	logger = common.GetLogger("scheduler")
+
+	errThrottled = errors.New("rate limited longer than a hand-off")
+
+	_ core.IStoredScheduler  = &basicScheduler{}
+	_ core.IDeadLetterRouter = &basicScheduler{}
+)
+
+const (
+	overflowDelay  = 1  // seconds a new task is parked in the delay store while the fetchers are congested
+	overflowFactor = 10 // times the limit of scheduler2FetcherQ the delay store may grow to with parked new tasks
 )
 
 func NewScheduler(newQ, s2fQ, sQ core.IQueue, hooks ...core.SchedulerHook) core.IScheduler {
@@ -37,8 +57,10 @@ func NewScheduler(newQ, s2fQ, sQ core.IQueue, hooks ...core.SchedulerHook) core.
 	s.newTaskQ = newQ
 	s.scheduler2FetcherQ = s2fQ
 	s.statusQ = sQ
+	s.inbox = &core.Inbox{Stage: core.StageScheduler, Queue: newQ, Logger: logger}
 	s.pause = false
 	s.isRunning = false
+	s.done = make(chan struct{})
 	s.wg = new(sync.WaitGroup)
 
 	nameSet := make(map[string]bool)
@@ -54,7 +76,10 @@ func NewScheduler(newQ, s2fQ, sQ core.IQueue, hooks ...core.SchedulerHook) core.
 
 func (s *basicScheduler) Shutdown() {
 	s.Lock()
-	s.pause = true
+	if !s.pause {
+		s.pause = true
+		close(s.done)
+	}
 	s.Unlock()
 
 	s.wg.Wait()
@@ -63,6 +88,42 @@ func (s *basicScheduler) Shutdown() {
 
 }
 
+func (s *basicScheduler) SetDeadLetterQueue(q core.IQueue) {
+	s.Lock()
+	defer s.Unlock()
+	s.inbox.DeadQ = q
+}
+
+// SetDelayStore set where tasks wait for their Schedule.ExecuteTime, without one they are dispatched at once.
+// New tasks wait there too while scheduler2FetcherQ is congested, which a bounded newTaskQ needs to keep draining.
+func (s *basicScheduler) SetDelayStore(store core.IDelayStore) {
+	s.Lock()
+	defer s.Unlock()
+	s.delayStore = store
+}
+
+// SetTaskStore set where tasks are recorded to drop the duplicated ones, without one nothing is dropped
+func (s *basicScheduler) SetTaskStore(store core.ITaskStore) {
+	s.Lock()
+	defer s.Unlock()
+	s.taskStore = store
+}
+
+// SetRateLimiter set the politeness limits of hosts and projects, tasks over them are held in the delay store,
+// or wait in the scheduler without one, up to core.MaxHandOffWait. Schedulers sharing a redis limiter share the limits.
+func (s *basicScheduler) SetRateLimiter(limiter core.IRateLimiter, conf core.RateLimitConfig) {
+	s.Lock()
+	defer s.Unlock()
+	s.rateLimiter = limiter
+	s.rateLimit = conf
+}
+
+func (s *basicScheduler) paused() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.pause
+}
+
 func (s *basicScheduler) Run() {
 
 	s.Lock()
@@ -78,9 +139,14 @@ func (s *basicScheduler) Run() {
 
 	var finished = 0
 	projectList := core.GetProjectManager().List()
-	var totalCount = 1 + len(projectList)
+	var totalCount = 4 + len(projectList)
 
+	// counted before they start, so Shutdown can not miss one
+	s.wg.Add(totalCount)
 	go s.processTaskQueue(finC)
+	go s.processDelayed(finC)
+	go s.processRecrawl(finC)
+	go s.processStatusQueue(finC)
 	for _, project := range projectList {
 		go s.processProjectCron(project, finC)
 	}
@@ -102,7 +168,6 @@ func (s *basicScheduler) processProjectCron(project core.IProject, fin chan stru
 	defer func() {
 		fin <- struct{}{}
 	}()
-	s.wg.Add(1)
 	defer s.wg.Done()
 
 	type st struct {
@@ -123,13 +188,13 @@ func (s *basicScheduler) processProjectCron(project core.IProject, fin chan stru
 	projectName := project.GetName()
 	logger.Infof("start cron jobs for %v, count=%d", projectName, len(cronMap))
 
-	for !s.pause {
+	for !s.paused() {
 		now := datetime.NowUnix()
 		for name, cst := range cronMap {
 			if now-cst.lst >= cst.every {
 
 				s.wg.Add(1)
-				s.selectTask(&core.Task{
+				_ = s.selectTask(&core.Task{
 					Url:     core.SystemTaskSchema + "://" + name,
 					Project: projectName,
 					Status:  core.TaskStatusInit,
@@ -145,7 +210,7 @@ func (s *basicScheduler) processProjectCron(project core.IProject, fin chan stru
 			}
 		}
 
-		if !s.pause {
+		if !s.paused() {
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
@@ -155,51 +220,421 @@ func (s *basicScheduler) processTaskQueue(fin chan struct{}) {
 	defer func() {
 		fin <- struct{}{}
 	}()
-	s.wg.Add(1)
-
 	defer s.wg.Done()
 
 	var oneBatchSize = 1000
 	var sleepIdle = 1000 * time.Millisecond
-	var sleepInterval = 100 * time.Millisecond
+	var receiveTimeout = time.Second
+	var requeueInterval = 30 * time.Second
+	var lastRequeue = time.Now()
+
+	for !s.paused() {
+		if time.Since(lastRequeue) >= requeueInterval {
+			if cnt := core.Requeue(s.newTaskQ); cnt > 0 {
+				logger.WithField("count", cnt).Warn("requeue expired messages")
+			}
+			lastRequeue = time.Now()
+		}
+
+		// with room in the delay store newTaskQ keeps draining while the fetchers catch up, see overflow, otherwise
+		// the processors may wait for room in newTaskQ while the fetchers wait for them, and the scheduler for the fetchers
+		batchSize := oneBatchSize
+		if core.IsCongested(s.scheduler2FetcherQ) {
+			if room := s.overflowRoom(); room < batchSize {
+				batchSize = room
+			}
+		}
+		if batchSize < 1 { // let the fetchers catch up
+			logger.WithField("queue", s.scheduler2FetcherQ.Name()).Debug("downstream congested")
+			time.Sleep(sleepIdle)
+			continue
+		}
 
-	for !s.pause {
-		messages := s.newTaskQ.Pop(oneBatchSize)
-		count := len(messages)
-		if count > 0 {
+		messages := core.Receive(s.newTaskQ, batchSize, receiveTimeout)
+		if len(messages) > 0 {
 			for _, msg := range messages {
+				if core.Attempts(s.newTaskQ, msg) > core.MaxDeliveryAttempts {
+					logger.WithFields(logrus.Fields{
+						"task": msg,
+						"op":   "abandon_new",
+					}).Warn("too many attempts")
+					s.inbox.Dead(msg, core.DeadReasonRetryExceeded, nil)
+					continue
+				}
 				task := core.Task{}
 				if err := json.Unmarshal([]byte(msg), &task); err != nil {
 					logger.WithError(err).WithFields(logrus.Fields{
 						"task": msg,
 						"op":   "abandon_new",
 					}).Warn("invalid task message")
+					s.inbox.Dead(msg, core.DeadReasonInvalidMessage, err)
 					continue
 				}
-				go s.receiveNewTask(&task)
+				s.wg.Add(1)
+				atomic.AddInt32(&s.receiving, 1)
+				go s.receiveNewTask(msg, &task)
 			}
+		}
+	}
+}
+
+func (s *basicScheduler) receiveNewTask(msg string, task *core.Task) {
+	defer s.wg.Done()
+	defer atomic.AddInt32(&s.receiving, -1)
+
+	defer func() {
+		if e := recover(); e != nil {
+			logger.WithField("panic", e).WithField("taskid", task.TaskId).Error("receive new task panic")
+			s.inbox.Dead(msg, core.DeadReasonPanic, fmt.Errorf("%v", e))
+		}
+	}()
+
+	s.onReceiveNew(task)
+
+	if isNew, err := s.record(task); err != nil {
+		s.inbox.Nack(msg)
+		return
+	} else if !isNew {
+		logger.WithField("taskid", task.TaskId).WithField("url", task.Url).Debug("duplicated task")
+		s.inbox.Ack(msg)
+		return
+	}
+
+	if held, err := s.hold(task); err != nil {
+		s.inbox.Nack(msg)
+		return
+	} else if held {
+		s.inbox.Ack(msg)
+		return
+	}
+
+	if parked, err := s.overflow(task); err != nil {
+		s.inbox.Nack(msg)
+		return
+	} else if parked {
+		s.inbox.Ack(msg)
+		return
+	}
+
+	//TODO 调度算法优化
+	if err := s.selectTask(task); err == errThrottled { // it only waited for its tokens
+		s.inbox.Release(msg)
+		return
+	} else if err != nil {
+		s.inbox.GiveBack(msg, err)
+		return
+	}
+	s.inbox.Ack(msg)
+}
+
+// record save task in the task store, it returns false for a task already seen,
+// unless it is forced or the stored one is older than its Schedule.Age
+func (s *basicScheduler) record(task *core.Task) (bool, error) {
+	if s.taskStore == nil {
+		return true, nil
+	}
+
+	if task.TaskId == "" {
+		if project, ok := core.GetProjectManager().Get(task.Project); ok {
+			task.TaskId = project.TaskId(task)
+		} else {
+			return true, nil
+		}
+	}
+
+	now := datetime.NowUnix()
+	if old, exists := s.taskStore.Get(task.Project, task.TaskId); exists {
+		if !task.Schedule.Force && !isExpired(old, now) {
+			return false, nil
+		}
+		task.CreateTime = old.CreateTime
+		task.LastCrawl = old.LastCrawl
+	}
+	task.UpdateTime = now
+
+	if err := s.taskStore.Save(task); err != nil {
+		logger.WithError(err).WithField("taskid", task.TaskId).WithField("op", "record").Error("fail")
+		return false, err
+	}
+	return true, nil
+}
+
+// isExpired tells whether a stored task is older than its Schedule.Age, a zero age never expires
+func isExpired(task *core.Task, now int64) bool {
+	if task.Schedule.Age <= 0 {
+		return false
+	}
+	last := task.LastCrawl
+	if last == 0 { // dispatched but not crawled yet
+		last = task.UpdateTime
+	}
+	return last+task.Schedule.Age <= now
+}
+
+// hold put a task whose ExecuteTime is in the future into the delay store
+func (s *basicScheduler) hold(task *core.Task) (bool, error) {
+	if task.Schedule.ExecuteTime <= datetime.NowUnix() {
+		return false, nil
+	}
+	if s.delayStore == nil {
+		logger.WithField("taskid", task.TaskId).WithField("retried", task.Schedule.Retried).
+			Warn("dispatched before its execute time, there is no delay store")
+		return false, nil
+	}
+	if err := s.delay(task, task.Schedule.ExecuteTime); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// overflow park task in the delay store while scheduler2FetcherQ is congested, it is released by processDelayed
+// once the fetchers catch up. Without room in the delay store the task waits for room in scheduler2FetcherQ.
+func (s *basicScheduler) overflow(task *core.Task) (bool, error) {
+	if !core.IsCongested(s.scheduler2FetcherQ) || s.overflowRoom() < 0 { // task itself is on the way
+		return false, nil
+	}
+	if err := s.delay(task, datetime.NowUnix()+overflowDelay); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
+// overflowRoom tells how many more new tasks the delay store has room to park, it takes up to overflowFactor
+// times the limit of scheduler2FetcherQ, counting the tasks delayed for their execute time and the ones on the way
+func (s *basicScheduler) overflowRoom() int {
+	if s.delayStore == nil {
+		return 0
+	}
+	return overflowFactor*s.scheduler2FetcherQ.Limit() - s.delayStore.Size() - int(atomic.LoadInt32(&s.receiving))
+}
+
+// delay put task into the delay store until due
+func (s *basicScheduler) delay(task *core.Task, due int64) error {
+	var tskBytes []byte
+	var err error
+	if tskBytes, err = json.Marshal(task); err == nil {
+		err = s.delayStore.Add(string(tskBytes), due)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("taskid", task.TaskId).WithField("op", "delay").Error("fail")
+	}
+	return err
+}
+
+// throttle reserve a token of every limit applying to task, a task whose tokens are not due yet is put into
+// the delay store until they are and true is returned. Waits shorter than the second the delay store counts in,
+// or all of them without a delay store, are waited here, but not past core.MaxHandOffWait nor shutdown,
+// errThrottled is returned then and the tokens are lost.
+// The delayed copy keeps when its tokens are due in Schedule.Reserved, so it is not throttled again but only
+// waits for them at dispatch, task itself is not marked. It is released from the delay store a second early,
+// which is polled once a second, so the tokens falling due within that second are not dispatched at once.
+func (s *basicScheduler) throttle(task *core.Task) (bool, error) {
+	if task.Schedule.Reserved > 0 {
+		wait := time.Duration(task.Schedule.Reserved-time.Now().UnixNano()/int64(time.Millisecond)) * time.Millisecond
+		if !s.wait(wait) {
+			return false, errThrottled
+		}
+		task.Schedule.Reserved = 0
+		return false, nil
+	}
+	if s.rateLimiter == nil {
+		return false, nil
+	}
+
+	keys, limits := s.rateLimit.Limits(task)
+	if len(keys) == 0 {
+		return false, nil
+	}
+	wait, err := s.rateLimiter.Reserve(keys, limits)
+	if err != nil {
+		logger.WithError(err).WithField("keys", keys).WithField("op", "throttle").Error("fail")
+		return false, err
+	}
+	if wait <= 0 {
+		return false, nil
+	}
+
+	if s.delayStore != nil && wait >= time.Second {
+		dueAt := time.Now().Add(wait)
+		reserved := *task
+		reserved.Schedule.Reserved = dueAt.UnixNano() / int64(time.Millisecond)
+		if err = s.delay(&reserved, dueAt.Unix()-1); err != nil {
+			return false, err
 		}
-		if !s.pause {
-			if count < oneBatchSize {
-				time.Sleep(sleepIdle)
+		return true, nil
+	}
+	if wait > core.MaxHandOffWait {
+		wait = core.MaxHandOffWait
+		err = errThrottled
+	}
+	if !s.wait(wait) {
+		return false, errThrottled
+	}
+	return false, err
+}
+
+// wait sleep for d, it returns false when the scheduler is shut down first
+func (s *basicScheduler) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// processDelayed release the tasks in the delay store to the fetcher when they are due
+func (s *basicScheduler) processDelayed(fin chan struct{}) {
+	defer func() {
+		fin <- struct{}{}
+	}()
+	defer s.wg.Done()
+
+	var oneBatchSize = 100
+	var sleepIdle = 1000 * time.Millisecond
+
+	for !s.paused() {
+		var messages []string
+		if s.delayStore != nil && !core.IsCongested(s.scheduler2FetcherQ) {
+			messages = s.delayStore.PopDue(datetime.NowUnix(), oneBatchSize)
+		}
+
+		for _, msg := range messages {
+			task := &core.Task{}
+			if err := json.Unmarshal([]byte(msg), task); err != nil {
+				logger.WithError(err).WithFields(logrus.Fields{
+					"task": msg,
+					"op":   "abandon_delayed",
+				}).Warn("invalid task message")
+				s.deadDelayed(msg, err)
+				continue
+			}
+			if task.Schedule.Reserved > 0 { // it waits for its tokens, which fall due one by one, see throttle
+				s.wg.Add(1)
+				go func(msg string, task *core.Task) {
+					defer s.wg.Done()
+					s.releaseDelayed(msg, task)
+				}(msg, task)
 			} else {
-				time.Sleep(sleepInterval)
+				s.releaseDelayed(msg, task)
 			}
 		}
+
+		if len(messages) < oneBatchSize && !s.paused() {
+			time.Sleep(sleepIdle)
+		}
 	}
 }
 
-func (s *basicScheduler) receiveNewTask(task *core.Task) {
-	s.wg.Add(1)
+// deadDelayed give up a message popped from the delay store as a dead letter of newTaskQ, where it is re-driven to,
+// it is put back to try again in the next round when the dead letter can not be sent
+func (s *basicScheduler) deadDelayed(msg string, err error) {
+	if s.inbox.DeadQ == nil {
+		return
+	}
+	dl := core.NewDeadLetter(core.StageScheduler, s.newTaskQ, core.DeadReasonInvalidMessage, err, msg)
+	if e := core.SendDeadLetter(s.inbox.DeadQ, dl); e != nil {
+		logger.WithError(e).WithField("op", "deadLetter").Error("fail")
+		_ = s.delayStore.Add(msg, datetime.NowUnix())
+	}
+}
+
+// releaseDelayed dispatch a task popped from the delay store, it is put back to try again in the next round
+func (s *basicScheduler) releaseDelayed(msg string, task *core.Task) {
+	if err := s.selectTask(task); err != nil {
+		_ = s.delayStore.Add(msg, datetime.NowUnix())
+	}
+}
+
+// processRecrawl dispatch the auto recrawl tasks in the task store again when they are due
+func (s *basicScheduler) processRecrawl(fin chan struct{}) {
+	defer func() {
+		fin <- struct{}{}
+	}()
 	defer s.wg.Done()
-	s.onReceiveNew(task)
-	//TODO 调度算法优化
-	s.selectTask(task)
 
+	var oneBatchSize = 100
+	var claimLease int64 = 60
+	var sleepIdle = 1000 * time.Millisecond
+
+	for !s.paused() {
+		var tasks []*core.Task
+		if s.taskStore != nil {
+			tasks = s.taskStore.DueRecrawl(datetime.NowUnix(), claimLease, oneBatchSize)
+		}
+
+		for _, task := range tasks {
+			task.Status = core.TaskStatusInit
+			task.Schedule.Retried = 0 // a new crawl, with all its retries
+			task.Schedule.Force = false
+			if err := s.selectTask(task); err != nil { // due again when the claim expires
+				continue
+			}
+			// the next crawl is Age later than now, or than the crawl confirmed by the fetcher, only the time
+			// is saved, the status of the dispatched task may be recorded already
+			now := datetime.NowUnix()
+			err := s.taskStore.Update(task.Project, task.TaskId, func(stored *core.Task) bool {
+				stored.UpdateTime = now
+				return true
+			})
+			if err != nil {
+				logger.WithError(err).WithField("taskid", task.TaskId).WithField("op", "recrawl").Error("fail")
+			}
+		}
+
+		if len(tasks) < oneBatchSize && !s.paused() {
+			time.Sleep(sleepIdle)
+		}
+	}
+}
+
+// processStatusQueue consume the task status published by the other components into the task store
+func (s *basicScheduler) processStatusQueue(fin chan struct{}) {
+	defer func() {
+		fin <- struct{}{}
+	}()
+	defer s.wg.Done()
+	if s.statusQ == nil {
+		return
+	}
+
+	var oneBatchSize = 100
+	var receiveTimeout = time.Second
+
+	for !s.paused() {
+		for _, msg := range core.Receive(s.statusQ, oneBatchSize, receiveTimeout) {
+			st := core.StatusMessage{}
+			if err := json.Unmarshal([]byte(msg), &st); err != nil {
+				logger.WithError(err).WithField("status", msg).Warn("invalid status message")
+			} else if err = s.updateStatus(&st); err != nil {
+				// a lost status only delays the next recrawl, it is not worth to retry
+				logger.WithError(err).WithField("taskid", st.TaskId).WithField("op", "updateStatus").Error("fail")
+			}
+			if err := core.Ack(s.statusQ, msg); err != nil {
+				logger.WithError(err).WithField("op", "ack").Error("fail")
+			}
+		}
+	}
 }
 
-func (s *basicScheduler) selectTask(task *core.Task) {
+// updateStatus record a status message into the task store
+func (s *basicScheduler) updateStatus(st *core.StatusMessage) error {
+	if s.taskStore == nil {
+		return nil
+	}
+	return s.taskStore.Update(st.Project, st.TaskId, st.Apply)
+}
+
+func (s *basicScheduler) selectTask(task *core.Task) error {
+	if throttled, err := s.throttle(task); err != nil || throttled {
+		return err
+	}
+
 	task.Status = core.TaskStatusScheduled
 	msg := core.Schedule2FetchMessage{Task: task}
 
@@ -207,8 +642,11 @@ func (s *basicScheduler) selectTask(task *core.Task) {
 	var err error
 
 	if msgBytes, err = json.Marshal(&msg); err == nil {
-		if err = s.scheduler2FetcherQ.Put(string(msgBytes)); err == nil {
+		if err = core.PutWait(s.scheduler2FetcherQ, core.HandOffStop(s.paused), string(msgBytes)); err == nil {
 			s.onSelect(task)
+			if e := core.SendStatus(s.statusQ, core.StageScheduler, task, core.TaskStatusScheduled, nil); e != nil {
+				logger.WithError(e).WithField("taskid", task.TaskId).WithField("op", "sendStatus").Error("fail")
+			}
 		}
 	}
 
@@ -218,6 +656,7 @@ func (s *basicScheduler) selectTask(task *core.Task) {
 			"task": string(msgBytes),
 		}).Error("fail")
 	}
+	return err
 }
 func (s *basicScheduler) onReceiveNew(task *core.Task) {
 	for _, h := range s.hooks {
@@ -241,5 +680,17 @@ func (s *basicScheduler) HttpServe() http.HandlerFunc {
 	eng.GET("/", func(context *gin.Context) {
 		context.String(http.StatusOK, "pong")
 	})
+	// where a task is right now, and when it last succeeded
+	eng.GET("/task/:project/:taskid", func(context *gin.Context) {
+		if s.taskStore == nil {
+			context.String(http.StatusNotFound, "no task store")
+			return
+		}
+		if task, ok := s.taskStore.Get(context.Param("project"), context.Param("taskid")); ok {
+			context.JSON(http.StatusOK, task)
+		} else {
+			context.String(http.StatusNotFound, "not found")
+		}
+	})
 	return eng.ServeHTTP
 }
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// BodyPolicy tells the fetcher how much of a response body to take, and where to keep it
+type BodyPolicy struct {
+	MaxSize      int64 `json:"max_size,omitempty"`      // bytes of a body, 0 for no limit
+	Truncate     bool  `json:"truncate,omitempty"`      // keep MaxSize bytes of a longer body, instead of StatusBodyTooLarge
+	StreamSize   int64 `json:"stream_size,omitempty"`   // bodies longer go to the blob store, 0 for none
+	StreamBinary bool  `json:"stream_binary,omitempty"` // bodies which are not text go to the blob store
+}
+
+var (
+	DefaultBodyPolicy = BodyPolicy{} // whole bodies in the messages, set a MaxSize to bound them
+)
+
+// IBodyConfigured is a project with a body policy of its own
+type IBodyConfigured interface {
+	GetBodyPolicy() *BodyPolicy // nil for DefaultBodyPolicy
+	SetBodyPolicy(policy BodyPolicy)
+}
+
+// TaskBodyPolicy returns the body policy of task, or else of its project, or else the default one
+func TaskBodyPolicy(task *Task) BodyPolicy {
+	if task.Fetch.Body != nil {
+		return *task.Fetch.Body
+	}
+	if project, ok := GetProjectManager().Get(task.Project); ok {
+		if configured, ok := project.(IBodyConfigured); ok {
+			if p := configured.GetBodyPolicy(); p != nil {
+				return *p
+			}
+		}
+	}
+	return DefaultBodyPolicy
+}
+
+const fileBlobScheme = "file://"
+
+// fileBlobStore keeps every blob in a file of its directory, the processor deletes a blob once its response
+// is processed, the ones of the dead letters are kept
+type fileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore returns a blob store in the local directory dir, which is created when needed
+func NewFileBlobStore(dir string) IBlobStore {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return &fileBlobStore{dir: dir}
+}
+
+func (fs *fileBlobStore) Put(r io.Reader) (ref string, size int64, err error) {
+	if err = os.MkdirAll(fs.dir, 0755); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(fs.dir, "blob-"); err != nil {
+		return
+	}
+	if size, err = io.Copy(f, r); err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", 0, err
+	}
+	return fileBlobScheme + f.Name(), size, nil
+}
+
+// path returns the file of ref, which has to be in the directory of the store
+func (fs *fileBlobStore) path(ref string) (string, error) {
+	if !strings.HasPrefix(ref, fileBlobScheme) {
+		return "", errors.New("not a file blob: " + ref)
+	}
+	path := filepath.Clean(strings.TrimPrefix(ref, fileBlobScheme))
+	if filepath.Dir(path) != fs.dir {
+		return "", errors.New("blob out of the store: " + ref)
+	}
+	return path, nil
+}
+
+func (fs *fileBlobStore) Open(ref string) (io.ReadCloser, error) {
+	path, err := fs.path(ref)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (fs *fileBlobStore) Delete(ref string) error {
+	path, err := fs.path(ref)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+var (
+	gBlobStoreLock sync.RWMutex
+	gBlobStore     = NewFileBlobStore(filepath.Join(os.TempDir(), "spider-blobs"))
+)
+
+// SetBlobStore set the blob store of the fetcher and the processor, both of them have to see the same one
+func SetBlobStore(store IBlobStore) {
+	gBlobStoreLock.Lock()
+	defer gBlobStoreLock.Unlock()
+	gBlobStore = store
+}
+
+// GetBlobStore returns the blob store, a directory in the temp dir unless SetBlobStore
+func GetBlobStore() IBlobStore {
+	gBlobStoreLock.RLock()
+	defer gBlobStoreLock.RUnlock()
+	return gBlobStore
+}
+
+// Body returns the body of r, from the blob store when it is there, which is only until the callback returns:
+// a callback keeping the body for later has to copy it
+func (r *Response) Body() (io.ReadCloser, error) {
+	if r.Blob != "" {
+		return GetBlobStore().Open(r.Blob)
+	}
+	return ioutil.NopCloser(bytes.NewReader(r.Content)), nil
+}
@@ -0,0 +1,67 @@
+package core
+
+// the optional wiring of the components, each helper returns false when the component does not support it
+
+// SetDeadLetterQueue set the dead letter queue of a scheduler, fetcher, processor or result worker,
+// without one the messages given up are dropped
+func SetDeadLetterQueue(component interface{}, q IQueue) bool {
+	if r, ok := component.(IDeadLetterRouter); ok {
+		r.SetDeadLetterQueue(q)
+		return true
+	}
+	return false
+}
+
+// SetDelayStore set where the tasks of s wait for their Schedule.ExecuteTime
+func SetDelayStore(s IScheduler, store IDelayStore) bool {
+	if ss, ok := s.(IStoredScheduler); ok {
+		ss.SetDelayStore(store)
+		return true
+	}
+	return false
+}
+
+// SetTaskStore set where s records the tasks, to drop the duplicated ones and recrawl them
+func SetTaskStore(s IScheduler, store ITaskStore) bool {
+	if ss, ok := s.(IStoredScheduler); ok {
+		ss.SetTaskStore(store)
+		return true
+	}
+	return false
+}
+
+// SetRateLimiter set the politeness limits of the hosts and projects dispatched by s
+func SetRateLimiter(s IScheduler, limiter IRateLimiter, conf RateLimitConfig) bool {
+	if ss, ok := s.(IStoredScheduler); ok {
+		ss.SetRateLimiter(limiter, conf)
+		return true
+	}
+	return false
+}
+
+// SetConcurrency set how many tasks f fetches at the same time, and at most how many of one host
+func SetConcurrency(f IFetcher, workers int, perHost int) bool {
+	if tf, ok := f.(ITunableFetcher); ok {
+		tf.SetConcurrency(workers, perHost)
+		return true
+	}
+	return false
+}
+
+// SetTransportConfig set the connection pools of the transports of f
+func SetTransportConfig(f IFetcher, conf TransportConfig) bool {
+	if tf, ok := f.(ITunableFetcher); ok {
+		tf.SetTransportConfig(conf)
+		return true
+	}
+	return false
+}
+
+// SetProxyProvider set where f takes the proxies of the tasks without a Fetch.Proxy
+func SetProxyProvider(f IFetcher, provider IProxyProvider) bool {
+	if tf, ok := f.(ITunableFetcher); ok {
+		tf.SetProxyProvider(provider)
+		return true
+	}
+	return false
+}
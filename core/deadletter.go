@@ -0,0 +1,121 @@
+package core
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/xgo11/datetime"
+	"github.com/xgo11/texts"
+)
+
+// Define pipeline stages
+const (
+	StageScheduler    = "scheduler"
+	StageFetcher      = "fetcher"
+	StageProcessor    = "processor"
+	StageResultWorker = "result_worker"
+)
+
+// Define why a message is dead
+const (
+	DeadReasonInvalidMessage = "invalid_message"
+	DeadReasonNoProject      = "project_not_exists"
+	DeadReasonPanic          = "panic"
+	DeadReasonRetryExceeded  = "retry_exceeded"  // delivered too many times
+	DeadReasonRetryExhausted = "retry_exhausted" // failed after every retry of its RetrySchedule
+)
+
+var (
+	// a message delivered more than this times goes to the dead letter queue
+	MaxDeliveryAttempts = 5
+)
+
+type DeadLetter struct {
+	Id       string `json:"id"`
+	Stage    string `json:"stage"`
+	Queue    string `json:"queue"` // name of the queue the message was popped from
+	Reason   string `json:"reason"`
+	Error    string `json:"error"`
+	Message  string `json:"message"`
+	Attempts int    `json:"attempts"`
+	Time     int64  `json:"time"`
+}
+
+func NewDeadLetter(stage string, from IQueue, reason string, err error, message string) *DeadLetter {
+	dl := &DeadLetter{
+		Stage:    stage,
+		Queue:    from.Name(),
+		Reason:   reason,
+		Message:  message,
+		Attempts: Attempts(from, message),
+		Time:     datetime.NowUnix(),
+	}
+	if err != nil {
+		dl.Error = err.Error()
+	}
+	dl.Id = texts.Md5(stage + ":" + dl.Queue + ":" + message + ":" + strconv.FormatInt(datetime.NowUnixNano(), 10))
+	return dl
+}
+
+// SendDeadLetter put a dead letter into q
+func SendDeadLetter(q IQueue, dl *DeadLetter) error {
+	bytes, err := json.Marshal(dl)
+	if err == nil {
+		err = q.Put(string(bytes))
+	}
+	return err
+}
+
+// Inbox settles the messages a stage reserves from its input Queue, and logs what fails. The messages given up
+// go to DeadQ, they are dropped without one.
+type Inbox struct {
+	Stage  string
+	Queue  IQueue
+	DeadQ  IQueue
+	Logger logrus.FieldLogger
+}
+
+// Dead move a reserved message into DeadQ, it is nacked when the dead letter can not be sent
+func (in *Inbox) Dead(message string, reason string, err error) {
+	if in.DeadQ != nil {
+		dl := NewDeadLetter(in.Stage, in.Queue, reason, err, message)
+		if e := SendDeadLetter(in.DeadQ, dl); e != nil {
+			in.Logger.WithError(e).WithField("op", "deadLetter").Error("fail")
+			in.Nack(message)
+			return
+		}
+	}
+	in.Ack(message)
+}
+
+func (in *Inbox) Ack(message string) {
+	if err := Ack(in.Queue, message); err != nil {
+		in.Logger.WithError(err).WithField("op", "ack").Error("fail")
+	}
+}
+
+func (in *Inbox) Nack(message string) {
+	if err := Nack(in.Queue, message); err != nil {
+		in.Logger.WithError(err).WithField("op", "nack").Error("fail")
+	}
+}
+
+// Release give back a message which was never worked on, its delivery is not counted as an attempt
+func (in *Inbox) Release(message string) {
+	if err := Release(in.Queue, message); err != nil {
+		in.Logger.WithError(err).WithField("op", "release").Error("fail")
+	}
+}
+
+// GiveBack return a message whose hand-off downstream failed with err, one which only waited for room
+// is released, so waiting does not use up its attempts
+func (in *Inbox) GiveBack(message string, err error) {
+	if err == ErrQueueFull {
+		in.Release(message)
+	} else {
+		in.Nack(message)
+	}
+}
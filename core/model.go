@@ -15,6 +15,8 @@ import (
 
 const (
 	DefaultPriority int = 5
+	MinPriority     int = 0
+	MaxPriority     int = 9
 	Utf8Encode          = "utf-8"
 )
 
@@ -25,6 +27,21 @@ const (
 	TaskStatusCrawled
 	TaskStatusProcessed
 	TaskStatusResulted
+	TaskStatusFailed
+)
+
+// Response.StatusCode of the fetches which got no http status
+const (
+	StatusInvalidTask    = 99  // no request can be made of the task
+	StatusFetchError     = 599 // the request failed
+	StatusConnectTimeout = 598 // TaskFetcher.ConnectTimeout exceeded
+	StatusTLSTimeout     = 597 // TaskFetcher.TLSTimeout exceeded
+	StatusHeaderTimeout  = 596 // TaskFetcher.HeaderTimeout exceeded
+	StatusTotalTimeout   = 595 // TaskFetcher.Timeout exceeded
+	StatusTLSError       = 594 // the TLS handshake failed, mostly the server certificate not verified
+	StatusBodyTooLarge   = 593 // BodyPolicy.MaxSize exceeded
+	StatusDecodeError    = 592 // the Content-Encoding can not be undone, the content is left as it came
+	StatusRedirectError  = 591 // stopped by the redirect policy, TaskFetcher.MaxRedirects
 )
 
 const (
@@ -38,6 +55,8 @@ type TaskSchedule struct {
 	Force       bool   `json:"force,omitemtpy" bson:"force"`
 	AutoRecrawl bool   `json:"auto_recrawl,omitemtpy" bson:"auto_recrawl"`
 	Age         int64  `json:"age,omitemtpy" bson:"age"`
+	Retried     int    `json:"retried,omitempty" bson:"retried"`   // scheduler retries after failures, see RetrySchedule
+	Reserved    int64  `json:"reserved,omitempty" bson:"reserved"` // unix ms the rate limit tokens a delayed task holds are due
 }
 
 type TaskFetcher struct {
@@ -46,11 +65,28 @@ type TaskFetcher struct {
 	Cookies        map[string]string `json:"cookies,omitemtpy" bson:"cookies"`
 	UseGzip        bool              `json:"use_gzip,omitemtpy" bson:"use_gzip"`
 	Data           string            `json:"data,omitemtpy" bson:"data"`
+	BinaryData     []byte            `json:"binary_data,omitempty" bson:"binary_data"` // raw body, base64 in json
+	Json           json.RawMessage   `json:"json,omitempty" bson:"json"`               // body sent as application/json
+	Form           map[string]string `json:"form,omitempty" bson:"form"`               // urlencoded, or multipart with Files
+	Files          []FormFile        `json:"files,omitempty" bson:"files"`             // multipart/form-data uploads
 	Proxy          string            `json:"proxy,omitemtpy" bson:"proxy"`
-	Retries        int               `json:"retries,omitemtpy" bson:"retries"`
+	Retries        int               `json:"retries,omitemtpy" bson:"retries"` // over RetryPolicy.MaxRetries, -1 never retries
 	MaxRedirects   int               `json:"max_redirects,omitemtpy" bson:"max_redirects"`
+	StopAtRedirect bool              `json:"stop_at_redirect,omitempty" bson:"stop_at_redirect"` // the 3xx response is the one returned
 	ConnectTimeout int               `json:"connect_timeout,omitemtpy" bson:"connect_timeout"`
-	Timeout        int               `json:"timeout,omitemtpy" bson:"timeout"`
+	TLSTimeout     int               `json:"tls_timeout,omitempty" bson:"tls_timeout"`       // seconds of the TLS handshake
+	HeaderTimeout  int               `json:"header_timeout,omitempty" bson:"header_timeout"` // seconds from the request sent to the response header
+	Timeout        int               `json:"timeout,omitemtpy" bson:"timeout"`               // seconds of the whole fetch, body included
+	TLS            *TLSConfig        `json:"tls,omitempty" bson:"tls"`                       // over the one of the project, see TaskTLSConfig
+	Body           *BodyPolicy       `json:"body,omitempty" bson:"body"`                     // over the one of the project, see TaskBodyPolicy
+}
+
+// FormFile is a file uploaded in a multipart/form-data body
+type FormFile struct {
+	Field       string `json:"field" bson:"field"`
+	FileName    string `json:"file_name" bson:"file_name"`
+	ContentType string `json:"content_type,omitempty" bson:"content_type"` // application/octet-stream if empty
+	Content     []byte `json:"content" bson:"content"`                     // base64 in json
 }
 
 type TaskProcessor struct {
@@ -72,11 +108,21 @@ type Task struct {
 	Save       map[string]interface{} `json:"save" bson:"save"`
 	UpdateTime int64                  `json:"update_time" bson:"update_time"`
 	LastCrawl  int64                  `json:"last_crawl" bson:"last_crawl"`
+
+	// lifecycle kept by the scheduler task store
+	StatusTime  int64  `json:"status_time,omitempty" bson:"status_time"`
+	StatusStage string `json:"status_stage,omitempty" bson:"status_stage"`
+	LastSuccess int64  `json:"last_success,omitempty" bson:"last_success"`
+	LastError   string `json:"last_error,omitempty" bson:"last_error"`
 }
 
 type StatusMessage struct {
-	TaskId string `json:"task_id"`
-	Status int    `json:"status"`
+	TaskId  string `json:"task_id"`
+	Project string `json:"project"`
+	Stage   string `json:"stage"`
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Time    int64  `json:"time"`
 }
 
 type Schedule2FetchMessage struct {
@@ -104,11 +150,38 @@ type Response struct {
 	TimeMS        int               `json:"time_ms"`
 	ErrMessage    string            `json:"err_message"`
 	Encoding      string            `json:"encoding"`
+	Attempts      []FetchAttempt    `json:"attempts,omitempty"` // every try, the last one included
+	Proxy         string            `json:"proxy,omitempty"`    // of the last try
+	Blob          string            `json:"blob,omitempty"`     // the body is in the blob store instead of Content
+	Truncated     bool              `json:"truncated,omitempty"`
+	Timing        *FetchTiming      `json:"timing,omitempty"`    // of the last try, nil when no request was made
+	Redirects     []RedirectHop     `json:"redirects,omitempty"` // of the last try, in the order followed
 
 	text string
 	doc  *goquery.Document
 }
 
+// RedirectHop is a response which redirected the fetch
+type RedirectHop struct {
+	Url        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+}
+
+// FetchTiming breaks down a try of a fetch, in milliseconds, the phases of every redirect hop are summed up
+type FetchTiming struct {
+	DNSMS       int    `json:"dns_ms"`
+	ConnectMS   int    `json:"connect_ms"`
+	TLSMS       int    `json:"tls_ms"`
+	ServerMS    int    `json:"server_ms"`     // from the request written to the first response byte
+	FirstByteMS int    `json:"first_byte_ms"` // from the start of the try to the first byte of the last response
+	TotalMS     int    `json:"total_ms"`      // of the try, the body read included
+	RemoteIP    string `json:"remote_ip,omitempty"`
+	Proto       string `json:"proto,omitempty"`
+	Reused      bool   `json:"reused"` // the last connection was an idle one
+	Attempts    int    `json:"attempts"`
+}
+
 type Result struct {
 	ErrCode      int    `json:"err_code"`
 	ErrMessage   string `json:"err_message"`
@@ -134,15 +207,28 @@ func NewTask(url string) (tsk *Task) {
 	return
 }
 
+// NextCrawl returns when an auto recrawl task is due again, Age seconds after it was
+// last crawled, or after it was last dispatched if that is later; 0 if it is not recrawled
+func (tsk *Task) NextCrawl() int64 {
+	if !tsk.Schedule.AutoRecrawl || tsk.Schedule.Age <= 0 {
+		return 0
+	}
+	last := tsk.LastCrawl
+	if tsk.UpdateTime > last {
+		last = tsk.UpdateTime
+	}
+	return last + tsk.Schedule.Age
+}
+
+// Update set the fields of kwArgs: method/headers/cookies/data/binary_data/json/form/files/use_gzip/callback,
+// a body turns a GET or HEAD task into a POST one unless method is given
 func (tsk *Task) Update(kwArgs map[string]interface{}) {
 
+	var hasBody bool
 	for k, v := range kwArgs {
-		// headers/data/method/use_gzip
 		switch k {
 		case "method":
-			if method, ok := v.(string); ok && method != "" {
-				tsk.Fetch.Method = strings.ToUpper(method)
-			}
+			// after the body ones
 		case "headers":
 			if headers, ok := v.(map[string]string); ok {
 				tsk.Fetch.Headers = headers
@@ -155,7 +241,30 @@ func (tsk *Task) Update(kwArgs map[string]interface{}) {
 			if data, ok := v.(string); ok && data != "" {
 				tsk.Fetch.Data = data
 			}
-			tsk.Fetch.Method = "POST"
+			hasBody = true
+		case "binary_data":
+			if data, ok := v.([]byte); ok {
+				tsk.Fetch.BinaryData = data
+				hasBody = true
+			}
+		case "json":
+			if data, ok := v.(json.RawMessage); ok {
+				tsk.Fetch.Json = data
+				hasBody = true
+			} else if data, err := json.Marshal(v); err == nil {
+				tsk.Fetch.Json = data
+				hasBody = true
+			}
+		case "form":
+			if form, ok := v.(map[string]string); ok {
+				tsk.Fetch.Form = form
+				hasBody = true
+			}
+		case "files":
+			if files, ok := v.([]FormFile); ok {
+				tsk.Fetch.Files = files
+				hasBody = true
+			}
 		case "use_gzip":
 			tsk.Fetch.UseGzip = true
 		case "callback":
@@ -167,6 +276,12 @@ func (tsk *Task) Update(kwArgs map[string]interface{}) {
 		}
 
 	}
+
+	if method, ok := kwArgs["method"].(string); ok && method != "" {
+		tsk.Fetch.Method = strings.ToUpper(method)
+	} else if hasBody && (tsk.Fetch.Method == "" || tsk.Fetch.Method == "GET" || tsk.Fetch.Method == "HEAD") {
+		tsk.Fetch.Method = "POST"
+	}
 }
 
 func (r *Response) initEncoding() {
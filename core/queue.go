@@ -0,0 +1,135 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// PriorityFunc tells the priority of a queued message, a larger one is delivered first
+type PriorityFunc func(message string) int
+
+var (
+	ErrQueueFull = errors.New("queue is full")
+
+	// a bounded queue over this ratio of its limit is congested, upstream should stop feeding it
+	HighWaterRatio = 0.8
+)
+
+const (
+	minFullWait = 100 * time.Millisecond
+	maxFullWait = 3 * time.Second
+
+	// MaxHandOffWait bounds how long a reserved message waits for room downstream, far shorter than its lease
+	MaxHandOffWait = time.Minute
+)
+
+// Reserve pop messages from q, reliable queues keep them in flight until Ack or Nack
+func Reserve(q IQueue, count int) []string {
+	if rq, ok := q.(IReliableQueue); ok {
+		return rq.Reserve(count)
+	}
+	return q.Pop(count)
+}
+
+// Receive reserve up to count messages from q, waiting up to timeout when q is empty,
+// queues that can not block are polled once and slept on instead
+func Receive(q IQueue, count int, timeout time.Duration) []string {
+	var messages []string
+	switch bq := q.(type) {
+	case IBlockingReliableQueue:
+		return bq.BReserve(timeout, count)
+	case IReliableQueue:
+		messages = bq.Reserve(count)
+	case IBlockingQueue:
+		return bq.BPop(timeout, count)
+	default:
+		messages = q.Pop(count)
+	}
+	if len(messages) < 1 {
+		time.Sleep(timeout)
+	}
+	return messages
+}
+
+// Ack confirm a message returned by Reserve is done, no-op for plain queues
+func Ack(q IQueue, message string) error {
+	if rq, ok := q.(IReliableQueue); ok {
+		return rq.Ack(message)
+	}
+	return nil
+}
+
+// Nack give a message returned by Reserve back to q for redelivery
+func Nack(q IQueue, message string) error {
+	if rq, ok := q.(IReliableQueue); ok {
+		return rq.Nack(message)
+	}
+	return q.Put(message)
+}
+
+// Release give a message returned by Reserve back to q as Nack does, but its delivery is not counted
+// as an attempt when q supports it, for a message which only waited for room downstream
+func Release(q IQueue, message string) error {
+	if rq, ok := q.(IReleasableQueue); ok {
+		return rq.Release(message)
+	}
+	return Nack(q, message)
+}
+
+// Requeue move in-flight messages whose lease expired back to q, returns the count
+func Requeue(q IQueue) int {
+	if rq, ok := q.(IReliableQueue); ok {
+		return rq.Requeue()
+	}
+	return 0
+}
+
+// Attempts returns how many times message has been delivered, 1 for plain queues
+func Attempts(q IQueue, message string) int {
+	if rq, ok := q.(IReliableQueue); ok {
+		return rq.Attempts(message)
+	}
+	return 1
+}
+
+// IsCongested returns whether a bounded q reached its high-water mark
+func IsCongested(q IQueue) bool {
+	if limit := q.Limit(); limit > 0 {
+		return float64(q.Size()) >= float64(limit)*HighWaterRatio
+	}
+	return false
+}
+
+// PutWait put messages into q, backing off while q is full until it succeeds or stop returns true
+func PutWait(q IQueue, stop func() bool, message ...string) error {
+	var wait = minFullWait
+	for {
+		err := q.Put(message...)
+		if err != ErrQueueFull || stop() {
+			return err
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > maxFullWait {
+			wait = maxFullWait
+		}
+	}
+}
+
+// HandOffStop tells PutWait when to give up handing a reserved message downstream: when paused returns true,
+// or after MaxHandOffWait. The message is to be given back by Release then, and delivered again later.
+func HandOffStop(paused func() bool) func() bool {
+	deadline := time.Now().Add(MaxHandOffWait)
+	return func() bool {
+		return paused() || time.Now().After(deadline)
+	}
+}
+
+// TaskPriority is the PriorityFunc for Schedule2FetchMessage, it reads Task.Schedule.Priority
+func TaskPriority(message string) int {
+	body := Schedule2FetchMessage{}
+	if err := json.Unmarshal([]byte(message), &body); err != nil || body.Task == nil {
+		return DefaultPriority
+	}
+	return body.Task.Schedule.Priority
+}
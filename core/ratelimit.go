@@ -0,0 +1,67 @@
+package core
+
+import (
+	"net/url"
+	"strings"
+)
+
+// RateLimit is a token bucket, QPS tokens are added per second and at most Burst are kept,
+// a zero QPS is unlimited
+type RateLimit struct {
+	QPS   float64 `json:"qps"`
+	Burst int     `json:"burst"`
+}
+
+func (l RateLimit) Unlimited() bool {
+	return l.QPS <= 0
+}
+
+// Capacity is the size of the bucket, at least one token
+func (l RateLimit) Capacity() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// RateLimitConfig tells the scheduler how fast tasks of a host or of a project can be dispatched
+type RateLimitConfig struct {
+	Host     RateLimit            `json:"host"`     // default limit of every host
+	Hosts    map[string]RateLimit `json:"hosts"`    // limits of some hosts, instead of the default one
+	Project  RateLimit            `json:"project"`  // default limit of every project
+	Projects map[string]RateLimit `json:"projects"` // limits of some projects, instead of the default one
+}
+
+// Limits returns the limiter keys and limits applying to task, unlimited ones are left out
+func (c *RateLimitConfig) Limits(task *Task) (keys []string, limits []RateLimit) {
+	if host := TaskHost(task); host != "" {
+		limit, ok := c.Hosts[host]
+		if !ok {
+			limit = c.Host
+		}
+		if !limit.Unlimited() {
+			keys = append(keys, "host:"+host)
+			limits = append(limits, limit)
+		}
+	}
+	if task.Project != "" {
+		limit, ok := c.Projects[task.Project]
+		if !ok {
+			limit = c.Project
+		}
+		if !limit.Unlimited() {
+			keys = append(keys, "project:"+task.Project)
+			limits = append(limits, limit)
+		}
+	}
+	return keys, limits
+}
+
+// TaskHost returns the lower case host name of the task url, empty for an invalid url
+func TaskHost(task *Task) string {
+	u, err := url.Parse(task.Url)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
@@ -0,0 +1,152 @@
+package core
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy tells the fetcher when and how long after to fetch a task again
+type RetryPolicy struct {
+	MaxRetries  int           `json:"max_retries"`  // retries after the first attempt
+	BaseDelay   time.Duration `json:"base_delay"`   // delay before the first retry, doubled for every next one
+	MaxDelay    time.Duration `json:"max_delay"`    // no delay is longer, a longer Retry-After gives up retrying
+	RetryStatus []int         `json:"retry_status"` // status codes retried as the transport errors are
+}
+
+// IRetryConfigured is a project with a retry policy of its own, the other projects take DefaultRetryPolicy
+type IRetryConfigured interface {
+	GetRetryPolicy() *RetryPolicy // nil for DefaultRetryPolicy
+	SetRetryPolicy(policy RetryPolicy)
+}
+
+var (
+	DefaultRetryPolicy = RetryPolicy{
+		MaxRetries:  2,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+		RetryStatus: []int{http.StatusTooManyRequests, 500, 502, 503, 504},
+	}
+)
+
+// RetrySchedule tells the scheduler when to crawl a failed task again, the n-th retry is Delays[n-1] seconds
+// after the failure, and a task failing once more than len(Delays) times is given up.
+// Only the projects setting one are retried so, the scheduler needs a delay store to hold the retries.
+type RetrySchedule struct {
+	Delays []int64 `json:"delays"`
+}
+
+// IRetryScheduled is a project opting in to the retries of the scheduler
+type IRetryScheduled interface {
+	GetRetrySchedule() *RetrySchedule // nil when the scheduler does not retry the failures
+	SetRetrySchedule(schedule RetrySchedule)
+}
+
+// TaskRetrySchedule returns the retry schedule of the project of task, false when it has none:
+// its failed fetches are given to the callbacks, and its failed callbacks are dead letters
+func TaskRetrySchedule(task *Task) (RetrySchedule, bool) {
+	if project, ok := GetProjectManager().Get(task.Project); ok {
+		if scheduled, ok := project.(IRetryScheduled); ok {
+			if s := scheduled.GetRetrySchedule(); s != nil {
+				return *s, true
+			}
+		}
+	}
+	return RetrySchedule{}, false
+}
+
+// TransientFailure tells whether a fetch ended with status code may go well later: the network errors,
+// the timeouts, and the 429 and 5xx of the servers. An invalid task, an untrusted certificate,
+// a body too large or not decodable fail the same way again.
+func TransientFailure(code int) bool {
+	switch code {
+	case StatusFetchError, StatusConnectTimeout, StatusTLSTimeout, StatusHeaderTimeout, StatusTotalTimeout,
+		http.StatusTooManyRequests:
+		return true
+	case StatusTLSError, StatusBodyTooLarge, StatusDecodeError, StatusRedirectError:
+		return false
+	}
+	return code >= 500 && code < 600
+}
+
+// Next returns the delay in seconds of the retry after retried ones, false when there is no more
+func (s RetrySchedule) Next(retried int) (int64, bool) {
+	if retried < 0 || retried >= len(s.Delays) {
+		return 0, false
+	}
+	return s.Delays[retried], true
+}
+
+// FetchAttempt is one try of a fetch, recorded in Response.Attempts
+type FetchAttempt struct {
+	StatusCode int    `json:"status_code"`
+	ErrMessage string `json:"err_message,omitempty"`
+	Proxy      string `json:"proxy,omitempty"`
+	TimeMS     int    `json:"time_ms"`
+	WaitMS     int    `json:"wait_ms,omitempty"` // before the next attempt
+}
+
+// TaskRetryPolicy returns the retry policy of the project of task, or the default one,
+// a positive Fetch.Retries of task overrides MaxRetries, and a negative one disables retrying
+func TaskRetryPolicy(task *Task) RetryPolicy {
+	policy := DefaultRetryPolicy
+	if project, ok := GetProjectManager().Get(task.Project); ok {
+		if configured, ok := project.(IRetryConfigured); ok {
+			if p := configured.GetRetryPolicy(); p != nil {
+				policy = *p
+			}
+		}
+	}
+	if task.Fetch.Retries > 0 {
+		policy.MaxRetries = task.Fetch.Retries
+	} else if task.Fetch.Retries < 0 {
+		policy.MaxRetries = 0
+	}
+	return policy
+}
+
+// RetryStatusCode tells whether a response of code is worth another attempt
+func (p RetryPolicy) RetryStatusCode(code int) bool {
+	for _, c := range p.RetryStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff is the delay before the retry-th retry, counted from 0,
+// exponential with a jitter of up to half of it, so the retries of a burst spread out
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half+1))
+	}
+	return delay
+}
+
+// RetryAfter parse the Retry-After header, in seconds or as a http date, 0 when there is none
+func RetryAfter(header http.Header, now time.Time) time.Duration {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		return 0
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"encoding/json"
+)
+
+import (
+	"github.com/xgo11/datetime"
+)
+
+// SendStatus publish the status of task at stage into q, it does nothing when q is nil
+func SendStatus(q IQueue, stage string, task *Task, status int, err error) error {
+	if q == nil || task == nil || task.TaskId == "" {
+		return nil
+	}
+
+	msg := StatusMessage{
+		TaskId:  task.TaskId,
+		Project: task.Project,
+		Stage:   stage,
+		Status:  status,
+		Time:    datetime.NowUnix(),
+	}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+
+	bytes, e := json.Marshal(&msg)
+	if e == nil {
+		e = q.Put(string(bytes))
+	}
+	return e
+}
+
+// Apply move task to the status in msg, it returns false for a message older than the current status.
+// Time is in seconds, within the same second the stages are ordered by the lifecycle.
+func (msg *StatusMessage) Apply(task *Task) bool {
+	if msg.Time < task.StatusTime || (msg.Time == task.StatusTime && msg.Status < task.Status) {
+		return false
+	}
+
+	task.Status = msg.Status
+	task.StatusTime = msg.Time
+	task.StatusStage = msg.Stage
+
+	switch msg.Status {
+	case TaskStatusCrawled:
+		task.LastCrawl = msg.Time
+	case TaskStatusProcessed, TaskStatusResulted:
+		task.LastSuccess = msg.Time
+		task.LastError = ""
+	case TaskStatusFailed:
+		task.LastError = msg.Error
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package core
+
+// TLSConfig tells the fetcher how to talk TLS, the server certificate is verified unless Insecure
+type TLSConfig struct {
+	Insecure   bool   `json:"insecure,omitempty" bson:"insecure"`       // skip verifying the server certificate
+	CAFile     string `json:"ca_file,omitempty" bson:"ca_file"`         // PEM bundle trusted instead of the system roots
+	CertFile   string `json:"cert_file,omitempty" bson:"cert_file"`     // PEM client certificate, with KeyFile
+	KeyFile    string `json:"key_file,omitempty" bson:"key_file"`       // PEM key of CertFile
+	MinVersion string `json:"min_version,omitempty" bson:"min_version"` // "1.0", "1.1", "1.2" or "1.3"
+	ServerName string `json:"server_name,omitempty" bson:"server_name"` // sent as SNI and verified, instead of the url host
+}
+
+// ITLSConfigured is a project with a TLS config of its own
+type ITLSConfigured interface {
+	GetTLSConfig() *TLSConfig // nil for the zero one
+	SetTLSConfig(conf TLSConfig)
+}
+
+// TaskTLSConfig returns the TLS config of task, or else of its project, or else the zero one,
+// which verifies against the system roots, the config of task replaces the one of the project as a whole
+func TaskTLSConfig(task *Task) TLSConfig {
+	if task.Fetch.TLS != nil {
+		return *task.Fetch.TLS
+	}
+	if project, ok := GetProjectManager().Get(task.Project); ok {
+		if configured, ok := project.(ITLSConfigured); ok {
+			if conf := configured.GetTLSConfig(); conf != nil {
+				return *conf
+			}
+		}
+	}
+	return TLSConfig{}
+}
@@ -1,6 +1,10 @@
 package core
 
-import "net/http"
+import (
+	"io"
+	"net/http"
+	"time"
+)
 
 type IShutdown interface {
 	Shutdown()
@@ -22,6 +26,110 @@ type IQueue interface {
 	Limit() int
 }
 
+// IReliableQueue is an at-least-once IQueue, a reserved message stays in flight
+// until it is acked, and goes back to the queue when nacked or when its lease expired
+type IReliableQueue interface {
+	IQueue
+	Reserve(count ...int) []string
+	Ack(message string) error
+	Nack(message string) error
+	Requeue() int
+	Attempts(message string) int
+	SetVisibility(timeout time.Duration)
+}
+
+// IReleasableQueue is a reliable queue taking a reserved message back without counting its delivery
+// as an attempt, for the messages which were never worked on
+type IReleasableQueue interface {
+	IReliableQueue
+	Release(message string) error
+}
+
+// IBlockingQueue is an IQueue whose pop waits up to timeout for the first message
+type IBlockingQueue interface {
+	IQueue
+	BPop(timeout time.Duration, count ...int) []string
+}
+
+// IBlockingReliableQueue is a reliable queue whose reserve waits up to timeout for the first message
+type IBlockingReliableQueue interface {
+	IReliableQueue
+	BReserve(timeout time.Duration, count ...int) []string
+}
+
+// IBrowsableQueue is an IQueue whose messages can be listed and removed without popping
+type IBrowsableQueue interface {
+	IQueue
+	Range(offset, limit int) []string
+	Remove(message string) error
+}
+
+// IDelayStore holds messages until they are due, due is a unix timestamp in seconds
+type IDelayStore interface {
+	Add(message string, due int64) error
+	PopDue(now int64, count int) []string
+	Size() int
+}
+
+// ITaskStore keeps the tasks known by the scheduler, keyed by project and task id,
+// tasks with Schedule.AutoRecrawl are indexed by their next crawl time
+type ITaskStore interface {
+	Get(project, taskId string) (*Task, bool)
+	Save(task *Task) error
+	// Update applies change to the stored task and saves it when change returns true, atomically
+	// against the other writers of the task; it does nothing for an unknown task
+	Update(project, taskId string, change func(task *Task) bool) error
+	// DueRecrawl claims up to count recrawl tasks due at now, they are not due again before now+lease
+	// so schedulers sharing the store never dispatch the same task twice
+	DueRecrawl(now int64, lease int64, count int) []*Task
+}
+
+// IRateLimiter keeps a token bucket per key
+type IRateLimiter interface {
+	// Reserve a token from the bucket of every key at once, a bucket without one lends its next token,
+	// it returns how long to wait before all the reserved tokens are due
+	Reserve(keys []string, limits []RateLimit) (time.Duration, error)
+}
+
+// IProxyProvider assigns a proxy to every request of the fetcher, and learns from how they went
+type IProxyProvider interface {
+	// Get a proxy for a request of task, empty for none
+	Get(task *Task) string
+	// Report the outcome of a request through proxy
+	Report(proxy string, ok bool)
+}
+
+// IProxyPool is an IProxyProvider over a list of proxies, which are scored and evicted by their outcomes
+type IProxyPool interface {
+	IProxyProvider
+	// Update replace the proxies, the scores of the ones kept are kept
+	Update(proxies []string)
+	Stats() []ProxyStat
+}
+
+// IBlobStore keeps the response bodies which are not to travel in the messages, see BodyPolicy
+type IBlobStore interface {
+	// Put store the content of r, the reference returned is what Response.Blob carries
+	Put(r io.Reader) (ref string, size int64, err error)
+	Open(ref string) (io.ReadCloser, error)
+	Delete(ref string) error
+}
+
+type ProxyStat struct {
+	Proxy     string `json:"proxy"`
+	Successes int    `json:"successes"`
+	Failures  int    `json:"failures"`
+	Evicted   bool   `json:"evicted"`
+}
+
+type IDeadLetterManager interface {
+	IHTTPServer
+	List(offset, limit int) []*DeadLetter
+	Get(id string) (*DeadLetter, bool)
+	Redrive(id string) error
+	RedriveAll() (int, error)
+}
+
 type Hook struct {
 	Name    string
 	Project string
@@ -39,18 +147,46 @@ type IScheduler interface {
 	IHTTPServer
 }
 
+// IDeadLetterRouter is a component moving the messages it gives up into a dead letter queue, see SetDeadLetterQueue
+type IDeadLetterRouter interface {
+	SetDeadLetterQueue(q IQueue)
+}
+
+// IStoredScheduler is a scheduler keeping its state in stores, see SetDelayStore, SetTaskStore and SetRateLimiter
+type IStoredScheduler interface {
+	SetDelayStore(store IDelayStore)
+	SetTaskStore(store ITaskStore)
+	SetRateLimiter(limiter IRateLimiter, conf RateLimitConfig)
+}
+
 type FetcherHook struct {
 	Hook
 	BeforeReq func(task *Task)
 	AfterReq  func(task *Task, resp *Response)
 }
 
+// TransportConfig sizes the connection pools of the fetcher transports, zero values take the defaults
+type TransportConfig struct {
+	MaxIdleConns        int           `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `json:"max_conns_per_host"` // 0 is unlimited
+	IdleConnTimeout     time.Duration `json:"idle_conn_timeout"`
+}
+
 type IFetcher interface {
 	IShutdown
 	IRunnable
 	IHTTPServer
 }
 
+// ITunableFetcher is a fetcher whose workers, transports and proxies can be set,
+// see SetConcurrency, SetTransportConfig and SetProxyProvider
+type ITunableFetcher interface {
+	SetConcurrency(workers int, perHost int)
+	SetTransportConfig(conf TransportConfig)
+	SetProxyProvider(provider IProxyProvider)
+}
+
 type ProcessHook struct {
 	Hook
 	OnSendNewTask func(*Task)
@@ -0,0 +1,155 @@
+package spider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.IDeadLetterManager = &deadLetterManager{}
+)
+
+const (
+	deadLetterScanBatch = 100
+)
+
+type deadLetterManager struct {
+	deadQ  core.IBrowsableQueue
+	queues map[string]core.IQueue
+}
+
+// NewDeadLetterManager manage the dead letters in deadQ, queues are where they can be re-driven to
+func NewDeadLetterManager(deadQ core.IQueue, queues ...core.IQueue) core.IDeadLetterManager {
+	bq, ok := deadQ.(core.IBrowsableQueue)
+	if !ok {
+		panic(fmt.Sprintf("dead letter queue %v is not browsable", deadQ.Name()))
+	}
+
+	m := &deadLetterManager{deadQ: bq, queues: map[string]core.IQueue{}}
+	for _, q := range queues {
+		m.queues[q.Name()] = q
+	}
+	return m
+}
+
+func (m *deadLetterManager) List(offset, limit int) []*core.DeadLetter {
+	var letters []*core.DeadLetter
+	for _, msg := range m.deadQ.Range(offset, limit) {
+		if dl := m.decode(msg); dl != nil {
+			letters = append(letters, dl)
+		}
+	}
+	return letters
+}
+
+func (m *deadLetterManager) Get(id string) (*core.DeadLetter, bool) {
+	dl, _ := m.find(id)
+	return dl, dl != nil
+}
+
+func (m *deadLetterManager) Redrive(id string) error {
+	dl, raw := m.find(id)
+	if dl == nil {
+		return errors.New("dead letter not found")
+	}
+	return m.redrive(dl, raw)
+}
+
+func (m *deadLetterManager) RedriveAll() (int, error) {
+	var count, skipped = 0, 0
+	for {
+		messages := m.deadQ.Range(skipped, deadLetterScanBatch)
+		for _, msg := range messages {
+			dl := m.decode(msg)
+			if dl == nil { // invalid ones are left in place
+				skipped++
+				continue
+			}
+			if err := m.redrive(dl, msg); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if len(messages) < deadLetterScanBatch {
+			return count, nil
+		}
+	}
+}
+
+// redrive put the original message back to its queue, then remove the dead letter
+func (m *deadLetterManager) redrive(dl *core.DeadLetter, raw string) error {
+	q, ok := m.queues[dl.Queue]
+	if !ok {
+		return fmt.Errorf("queue %v is not registered", dl.Queue)
+	}
+	if err := q.Put(dl.Message); err != nil {
+		return err
+	}
+	return m.deadQ.Remove(raw)
+}
+
+func (m *deadLetterManager) find(id string) (*core.DeadLetter, string) {
+	for offset := 0; ; offset += deadLetterScanBatch {
+		messages := m.deadQ.Range(offset, deadLetterScanBatch)
+		for _, msg := range messages {
+			if dl := m.decode(msg); dl != nil && dl.Id == id {
+				return dl, msg
+			}
+		}
+		if len(messages) < deadLetterScanBatch {
+			return nil, ""
+		}
+	}
+}
+
+func (m *deadLetterManager) decode(msg string) *core.DeadLetter {
+	dl := &core.DeadLetter{}
+	if err := json.Unmarshal([]byte(msg), dl); err != nil || dl.Id == "" {
+		logger.WithError(err).WithField("queue", m.deadQ.Name()).Warn("invalid dead letter")
+		return nil
+	}
+	return dl
+}
+
+func (m *deadLetterManager) HttpServe() http.HandlerFunc {
+	engine := gin.Default()
+	engine.GET("/", func(ctx *gin.Context) {
+		offset, _ := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+		limit, _ := strconv.Atoi(ctx.DefaultQuery("limit", "20"))
+		ctx.JSON(http.StatusOK, gin.H{
+			"size":    m.deadQ.Size(),
+			"letters": m.List(offset, limit),
+		})
+	})
+	engine.GET("/letter/:id", func(ctx *gin.Context) {
+		if dl, ok := m.Get(ctx.Param("id")); ok {
+			ctx.JSON(http.StatusOK, dl)
+		} else {
+			ctx.String(http.StatusNotFound, "not found")
+		}
+	})
+	engine.POST("/letter/:id/redrive", func(ctx *gin.Context) {
+		if err := m.Redrive(ctx.Param("id")); err != nil {
+			ctx.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		ctx.String(http.StatusOK, "ok")
+	})
+	engine.POST("/redrive", func(ctx *gin.Context) {
+		count, err := m.RedriveAll()
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"count": count, "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"count": count})
+	})
+	return engine.ServeHTTP
+}
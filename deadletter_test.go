@@ -0,0 +1,96 @@
+package spider
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/components/processor"
+	"github.com/xgo11/spider/components/scheduler"
+	"github.com/xgo11/spider/core"
+)
+
+func TestDeadLetterRedrive(t *testing.T) {
+	builder := newProject("deadletter_test")
+	builder.AddCallback(core.ProcessCallback{
+		Name: "boom",
+		Callback: func(task *core.Task, resp *core.Response) ([]*core.Task, *core.Result) {
+			panic("boom")
+		},
+	})
+	builder.(core.IRetryScheduled).SetRetrySchedule(core.RetrySchedule{}) // give up at once
+	builder.RegisterMe()
+
+	newQ := NewMemoryQueue("new", 0)
+	f2pQ := NewMemoryQueue("f2p", 0)
+	p2rQ := NewMemoryQueue("p2r", 0)
+	deadQ := NewMemoryQueue("dead_processor", 0)
+
+	p := processor.NewProcessor(newQ, f2pQ, p2rQ, nil)
+	core.SetDeadLetterQueue(p, deadQ)
+	stop := start(p)
+
+	task := UrlTask("http://localhost/", map[string]interface{}{"callback": "boom"})
+	task.Project = builder.GetName()
+	putFetched(t, f2pQ, task, &core.Response{StatusCode: 200})
+	_ = f2pQ.Put("not a json")
+
+	waitFor(5*time.Second, func() bool { return deadQ.Size() >= 2 })
+	stop()
+
+	m := NewDeadLetterManager(deadQ, newQ, f2pQ)
+	letters := m.List(0, 10)
+	if len(letters) != 2 {
+		t.Fatalf("expect 2 dead letters, got %d", len(letters))
+	}
+
+	var reasons = map[string]*core.DeadLetter{}
+	for _, dl := range letters {
+		if dl.Stage != core.StageProcessor {
+			t.Fatalf("unexpected dead letter %+v", dl)
+		}
+		reasons[dl.Reason] = dl
+	}
+	panicked, ok := reasons[core.DeadReasonRetryExhausted]
+	if !ok || panicked.Error != "boom" || panicked.Queue != "new" {
+		t.Fatalf("given up letter missing, got %+v", reasons)
+	}
+	if invalid, ok := reasons[core.DeadReasonInvalidMessage]; !ok || invalid.Queue != "f2p" {
+		t.Fatalf("invalid letter missing, got %+v", reasons)
+	}
+
+	if dl, ok := m.Get(panicked.Id); !ok || dl.Id != panicked.Id {
+		t.Fatal("get dead letter fail")
+	}
+	if err := m.Redrive(panicked.Id); err != nil {
+		t.Fatal(err)
+	}
+	if deadQ.Size() != 1 || newQ.Size() != 1 {
+		t.Fatalf("after redrive dead=%d new=%d", deadQ.Size(), newQ.Size())
+	}
+	if count, err := m.RedriveAll(); err != nil || count != 1 || deadQ.Size() != 0 {
+		t.Fatalf("redrive all count=%d err=%v", count, err)
+	}
+}
+
+func TestSchedulerDeadLettersInvalidDelayed(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+	deadQ := NewMemoryQueue("dead_scheduler", 0)
+	ds := NewMemoryDelayStore()
+	_ = ds.Add("not a json", 0)
+
+	s := scheduler.NewScheduler(newQ, s2fQ, nil)
+	core.SetDelayStore(s, ds)
+	core.SetDeadLetterQueue(s, deadQ)
+	defer start(s)()
+
+	if !waitFor(3*time.Second, func() bool { return deadQ.Size() == 1 }) {
+		t.Fatalf("an invalid delayed message should be given up as a dead letter")
+	}
+	dl := NewDeadLetterManager(deadQ, newQ).List(0, 1)[0]
+	if dl.Stage != core.StageScheduler || dl.Reason != core.DeadReasonInvalidMessage || dl.Queue != "new" {
+		t.Fatalf("it should be a dead letter of newTaskQ, got %+v", dl)
+	}
+}
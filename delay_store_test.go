@@ -0,0 +1,79 @@
+package spider
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/datetime"
+	"github.com/xgo11/spider/components/scheduler"
+	"github.com/xgo11/spider/core"
+)
+
+func TestMemoryDelayStore(t *testing.T) {
+	ds := NewMemoryDelayStore()
+	_ = ds.Add("later", 300)
+	_ = ds.Add("first", 100)
+	_ = ds.Add("second", 100)
+
+	if msgs := ds.PopDue(99, 10); len(msgs) != 0 {
+		t.Fatalf("nothing is due, got %v", msgs)
+	}
+	if msgs := ds.PopDue(200, 10); len(msgs) != 2 || msgs[0] != "first" || msgs[1] != "second" {
+		t.Fatalf("got %v", msgs)
+	}
+	if ds.Size() != 1 {
+		t.Fatalf("size = %d", ds.Size())
+	}
+}
+
+func TestSchedulerHoldsFutureTask(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+	ds := NewMemoryDelayStore()
+
+	s := scheduler.NewScheduler(newQ, s2fQ, nil)
+	core.SetDelayStore(s, ds)
+	defer start(s)()
+
+	task := UrlTask("http://localhost/later", nil)
+	task.Schedule.ExecuteTime = datetime.NowUnix() + 2
+	putTask(t, newQ, task)
+
+	waitFor(time.Second, func() bool { return ds.Size() > 0 })
+	if ds.Size() != 1 || s2fQ.Size() != 0 {
+		t.Fatalf("task should be held, delayed=%d dispatched=%d", ds.Size(), s2fQ.Size())
+	}
+
+	msgs := s2fQ.(core.IBlockingQueue).BPop(5 * time.Second)
+	if len(msgs) != 1 || ds.Size() != 0 {
+		t.Fatalf("task should be released when due, got %v", msgs)
+	}
+}
+
+func TestSchedulerBoundsOverflow(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 2)
+	ds := NewMemoryDelayStore()
+	_ = s2fQ.Put("a", "b") // the fetchers fell behind
+
+	s := scheduler.NewScheduler(newQ, s2fQ, nil)
+	core.SetDelayStore(s, ds)
+	defer start(s)()
+
+	for i := 0; i < 30; i++ {
+		putTask(t, newQ, UrlTask(fmt.Sprintf("http://localhost/%d", i), nil))
+	}
+	waitFor(time.Second, func() bool { return ds.Size() >= 20 })
+	time.Sleep(100 * time.Millisecond)
+	if ds.Size() != 20 || newQ.Size() != 10 {
+		t.Fatalf("only 10 times the limit of the fetchers should be parked, parked %d, left %d", ds.Size(), newQ.Size())
+	}
+
+	_ = s2fQ.Pop(2) // they catch up
+	if !waitFor(5*time.Second, func() bool { return newQ.Size() == 0 }) {
+		t.Fatalf("new tasks should be taken again, left %d", newQ.Size())
+	}
+}
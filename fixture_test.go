@@ -0,0 +1,64 @@
+package spider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+var projects int32
+
+// newProject build a project named after name, which is never registered yet,
+// the projects outlive a test and a test may be run again, as by -count
+func newProject(name string) core.IProjectBuilder {
+	return NewProjectBuilder(fmt.Sprintf("%s_%d", name, atomic.AddInt32(&projects, 1)))
+}
+
+type component interface {
+	core.IRunnable
+	core.IShutdown
+}
+
+// start run the components, the returned stop shuts them down
+func start(components ...component) (stop func()) {
+	for _, c := range components {
+		go c.Run()
+	}
+	return func() {
+		for _, c := range components {
+			c.Shutdown()
+		}
+	}
+}
+
+// putTask queue task, as the processor sends the new tasks to the scheduler
+func putTask(t *testing.T, q core.IQueue, task *core.Task) {
+	bytes, _ := json.Marshal(task)
+	if err := q.Put(string(bytes)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putFetched queue the response of task, as the fetcher sends it to the processor
+func putFetched(t *testing.T, q core.IQueue, task *core.Task, resp *core.Response) {
+	bytes, _ := json.Marshal(core.Fetch2ProcessMessage{Task: task, Response: resp})
+	if err := q.Put(string(bytes)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor poll cond until it holds, false when timeout passes first
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package spider
+
+import (
+	"container/heap"
+	"sync"
+)
+import (
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.IDelayStore = &memoryDelayStore{}
+)
+
+type delayItem struct {
+	message string
+	due     int64
+	seq     uint64
+}
+
+// delayHeap pops the earliest due first, then the oldest added
+type delayHeap []*delayItem
+
+func (h delayHeap) Len() int { return len(h) }
+
+func (h delayHeap) Less(i, j int) bool {
+	if h[i].due != h[j].due {
+		return h[i].due < h[j].due
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h delayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(*delayItem)) }
+
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return it
+}
+
+// memoryDelayStore is an in-process IDelayStore, what it holds is lost when the process exits
+type memoryDelayStore struct {
+	sync.Mutex
+
+	items delayHeap
+	seq   uint64
+}
+
+func NewMemoryDelayStore() core.IDelayStore {
+	return &memoryDelayStore{}
+}
+
+func (ms *memoryDelayStore) Add(message string, due int64) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.seq++
+	heap.Push(&ms.items, &delayItem{message: message, due: due, seq: ms.seq})
+	return nil
+}
+
+func (ms *memoryDelayStore) PopDue(now int64, count int) []string {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var messages []string
+	for len(messages) < count && ms.items.Len() > 0 && ms.items[0].due <= now {
+		messages = append(messages, heap.Pop(&ms.items).(*delayItem).message)
+	}
+	return messages
+}
+
+func (ms *memoryDelayStore) Size() int {
+	ms.Lock()
+	defer ms.Unlock()
+	return ms.items.Len()
+}
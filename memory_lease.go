@@ -0,0 +1,74 @@
+package spider
+
+import (
+	"errors"
+	"time"
+)
+
+type memoryLease struct {
+	count    int
+	deadline time.Time
+}
+
+// memoryLeases book-keeps the in-flight messages of an in-memory reliable queue,
+// it is not thread-safe, the queue holds its own lock around every call
+type memoryLeases struct {
+	inflight map[string]*memoryLease
+	attempts map[string]int
+}
+
+func (ml *memoryLeases) lease(message string, deadline time.Time) {
+	if ml.inflight == nil {
+		ml.inflight = map[string]*memoryLease{}
+		ml.attempts = map[string]int{}
+	}
+
+	ml.attempts[message]++
+	if lease, ok := ml.inflight[message]; ok {
+		lease.count++
+		lease.deadline = deadline
+	} else {
+		ml.inflight[message] = &memoryLease{count: 1, deadline: deadline}
+	}
+}
+
+// release end one lease of message, an acked message forgets its attempts once no copy is in flight
+func (ml *memoryLeases) release(message string, acked bool) error {
+	lease, ok := ml.inflight[message]
+	if !ok {
+		return errors.New("message is not in flight")
+	}
+	if lease.count--; lease.count <= 0 {
+		delete(ml.inflight, message)
+		if acked {
+			delete(ml.attempts, message)
+		}
+	}
+	return nil
+}
+
+// forget undo the attempt counted for a delivery of message, which was given back untouched
+func (ml *memoryLeases) forget(message string) {
+	if ml.attempts[message] > 0 {
+		ml.attempts[message]--
+	}
+}
+
+// expired remove and return the messages whose lease expired, one entry per copy
+func (ml *memoryLeases) expired(now time.Time) []string {
+	var messages []string
+	for msg, lease := range ml.inflight {
+		if lease.deadline.After(now) {
+			continue
+		}
+		for i := 0; i < lease.count; i++ {
+			messages = append(messages, msg)
+		}
+		delete(ml.inflight, msg)
+	}
+	return messages
+}
+
+func (ml *memoryLeases) deliveries(message string) int {
+	return ml.attempts[message]
+}
@@ -0,0 +1,283 @@
+package spider
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+import (
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.IQueue                 = &memoryPriorityQueue{}
+	_ core.IReliableQueue         = &memoryPriorityQueue{}
+	_ core.IBlockingQueue         = &memoryPriorityQueue{}
+	_ core.IBlockingReliableQueue = &memoryPriorityQueue{}
+	_ core.IReleasableQueue       = &memoryPriorityQueue{}
+)
+
+type priorityItem struct {
+	message  string
+	priority int
+	seq      uint64
+}
+
+// priorityHeap pops the highest priority first, then the oldest
+type priorityHeap []*priorityItem
+
+func (h priorityHeap) Len() int { return len(h) }
+
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityHeap) Push(x interface{}) { *h = append(*h, x.(*priorityItem)) }
+
+func (h *priorityHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return it
+}
+
+// memoryPriorityQueue is an in-process IQueue ordered by the priority of each message
+type memoryPriorityQueue struct {
+	sync.Mutex
+
+	name       string
+	limit      int
+	visibility time.Duration
+	priority   core.PriorityFunc
+	items      priorityHeap
+	seq        uint64
+	leases     memoryLeases
+	reserved   map[string][]*priorityItem // the items in flight, to be restored to their place
+	notify     chan struct{}              // closed and replaced whenever messages arrive
+}
+
+// NewMemoryPriorityQueue create an in-process priority queue for scheduler2FetcherQ,
+// tasks with a larger Schedule.Priority are popped first, limit <= 0 means unbounded
+func NewMemoryPriorityQueue(name string, limit int) core.IQueue {
+	if limit < 0 {
+		limit = 0
+	}
+	return &memoryPriorityQueue{
+		name:       name,
+		limit:      limit,
+		visibility: defaultVisibility,
+		priority:   core.TaskPriority,
+		notify:     make(chan struct{}),
+	}
+}
+
+func (pq *memoryPriorityQueue) Name() string {
+	return pq.name
+}
+
+func (pq *memoryPriorityQueue) Put(message ...string) error {
+	if len(message) < 1 {
+		return nil
+	}
+
+	pq.Lock()
+	defer pq.Unlock()
+
+	if pq.limit > 0 && pq.items.Len()+len(message) > pq.limit {
+		return core.ErrQueueFull
+	}
+	for _, msg := range message {
+		pq.seq++
+		heap.Push(&pq.items, &priorityItem{message: msg, priority: pq.priority(msg), seq: pq.seq})
+	}
+	pq.signal()
+	return nil
+}
+
+// signal wake up all waiters, must be called with the lock held
+func (pq *memoryPriorityQueue) signal() {
+	close(pq.notify)
+	pq.notify = make(chan struct{})
+}
+
+// waitLocked wait until there are messages or timeout, returns with the lock held
+func (pq *memoryPriorityQueue) waitLocked(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	pq.Lock()
+	for pq.items.Len() == 0 {
+		notify := pq.notify
+		pq.Unlock()
+		select {
+		case <-notify:
+		case <-timer.C:
+			pq.Lock()
+			return
+		}
+		pq.Lock()
+	}
+}
+
+func (pq *memoryPriorityQueue) Pop(count ...int) []string {
+	pq.Lock()
+	defer pq.Unlock()
+	return pq.pop(count...)
+}
+
+func (pq *memoryPriorityQueue) BPop(timeout time.Duration, count ...int) []string {
+	pq.waitLocked(timeout)
+	defer pq.Unlock()
+	return pq.pop(count...)
+}
+
+func (pq *memoryPriorityQueue) pop(count ...int) []string {
+	items := pq.popItems(count...)
+	msgArr := make([]string, 0, len(items))
+	for _, it := range items {
+		msgArr = append(msgArr, it.message)
+	}
+	return msgArr
+}
+
+func (pq *memoryPriorityQueue) popItems(count ...int) []*priorityItem {
+	cnt := 1
+	if len(count) > 0 && count[0] > 0 {
+		cnt = count[0]
+	}
+	if size := pq.items.Len(); cnt > size {
+		cnt = size
+	}
+
+	items := make([]*priorityItem, 0, cnt)
+	for i := 0; i < cnt; i++ {
+		items = append(items, heap.Pop(&pq.items).(*priorityItem))
+	}
+	return items
+}
+
+func (pq *memoryPriorityQueue) Size() int {
+	pq.Lock()
+	defer pq.Unlock()
+	return pq.items.Len()
+}
+
+func (pq *memoryPriorityQueue) Limit() int {
+	return pq.limit
+}
+
+func (pq *memoryPriorityQueue) Reserve(count ...int) []string {
+	pq.Lock()
+	defer pq.Unlock()
+	return pq.reserve(count...)
+}
+
+func (pq *memoryPriorityQueue) BReserve(timeout time.Duration, count ...int) []string {
+	pq.waitLocked(timeout)
+	defer pq.Unlock()
+	return pq.reserve(count...)
+}
+
+func (pq *memoryPriorityQueue) reserve(count ...int) []string {
+	if pq.reserved == nil {
+		pq.reserved = map[string][]*priorityItem{}
+	}
+	items := pq.popItems(count...)
+	msgArr := make([]string, 0, len(items))
+	deadline := time.Now().Add(pq.visibility)
+	for _, it := range items {
+		pq.leases.lease(it.message, deadline)
+		pq.reserved[it.message] = append(pq.reserved[it.message], it)
+		msgArr = append(msgArr, it.message)
+	}
+	return msgArr
+}
+
+// unreserve returns the item of a copy of message in flight
+func (pq *memoryPriorityQueue) unreserve(message string) *priorityItem {
+	items := pq.reserved[message]
+	if len(items) == 0 {
+		return &priorityItem{message: message, priority: pq.priority(message)}
+	}
+	if len(items) == 1 {
+		delete(pq.reserved, message)
+	} else {
+		pq.reserved[message] = items[1:]
+	}
+	return items[0]
+}
+
+func (pq *memoryPriorityQueue) Ack(message string) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	if err := pq.leases.release(message, true); err != nil {
+		return err
+	}
+	pq.unreserve(message)
+	return nil
+}
+
+func (pq *memoryPriorityQueue) Nack(message string) error {
+	return pq.nack(message, true)
+}
+
+// Release give message back as Nack does, but its delivery is not counted as an attempt
+func (pq *memoryPriorityQueue) Release(message string) error {
+	return pq.nack(message, false)
+}
+
+func (pq *memoryPriorityQueue) nack(message string, attempted bool) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	if err := pq.leases.release(message, false); err != nil {
+		return err
+	}
+	if !attempted {
+		pq.leases.forget(message)
+	}
+	pq.restore(message)
+	pq.signal()
+	return nil
+}
+
+// restore put a message in flight back to its place, ahead of the ones with the same priority put after it
+func (pq *memoryPriorityQueue) restore(message string) {
+	heap.Push(&pq.items, pq.unreserve(message))
+}
+
+func (pq *memoryPriorityQueue) Requeue() int {
+	pq.Lock()
+	defer pq.Unlock()
+
+	expired := pq.leases.expired(time.Now())
+	for _, msg := range expired {
+		pq.restore(msg)
+	}
+	if len(expired) > 0 {
+		pq.signal()
+	}
+	return len(expired)
+}
+
+func (pq *memoryPriorityQueue) Attempts(message string) int {
+	pq.Lock()
+	defer pq.Unlock()
+	return pq.leases.deliveries(message)
+}
+
+func (pq *memoryPriorityQueue) SetVisibility(timeout time.Duration) {
+	pq.Lock()
+	defer pq.Unlock()
+	if timeout > 0 {
+		pq.visibility = timeout
+	}
+}
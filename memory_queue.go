@@ -0,0 +1,242 @@
+package spider
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+import (
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.IQueue          = &memoryQueue{}
+	_ core.IReliableQueue  = &memoryQueue{}
+	_ core.IBrowsableQueue = &memoryQueue{}
+
+	_ core.IBlockingQueue         = &memoryQueue{}
+	_ core.IBlockingReliableQueue = &memoryQueue{}
+	_ core.IReleasableQueue       = &memoryQueue{}
+)
+
+// memoryQueue is an in-process IQueue, messages are kept in put order and
+// popped oldest first, the same as LPush/RPop on redisQueue.
+type memoryQueue struct {
+	sync.Mutex
+
+	name       string
+	limit      int
+	visibility time.Duration
+	messages   []string
+	leases     memoryLeases
+	notify     chan struct{} // closed and replaced whenever messages arrive
+}
+
+// NewMemoryQueue create a thread-safe in-process queue, limit <= 0 means unbounded
+func NewMemoryQueue(name string, limit int) core.IQueue {
+	if limit < 0 {
+		limit = 0
+	}
+	return &memoryQueue{name: name, limit: limit, visibility: defaultVisibility, notify: make(chan struct{})}
+}
+
+func (mq *memoryQueue) Name() string {
+	return mq.name
+}
+
+func (mq *memoryQueue) Put(message ...string) error {
+	if len(message) < 1 {
+		return nil
+	}
+
+	mq.Lock()
+	defer mq.Unlock()
+
+	if mq.limit > 0 && len(mq.messages)+len(message) > mq.limit {
+		return core.ErrQueueFull
+	}
+	mq.messages = append(mq.messages, message...)
+	mq.signal()
+	return nil
+}
+
+// signal wake up all waiters, must be called with the lock held
+func (mq *memoryQueue) signal() {
+	close(mq.notify)
+	mq.notify = make(chan struct{})
+}
+
+// waitLocked wait until there are messages or timeout, returns with the lock held
+func (mq *memoryQueue) waitLocked(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	mq.Lock()
+	for len(mq.messages) == 0 {
+		notify := mq.notify
+		mq.Unlock()
+		select {
+		case <-notify:
+		case <-timer.C:
+			mq.Lock()
+			return
+		}
+		mq.Lock()
+	}
+}
+
+func (mq *memoryQueue) BPop(timeout time.Duration, count ...int) []string {
+	mq.waitLocked(timeout)
+	defer mq.Unlock()
+	return mq.pop(count...)
+}
+
+func (mq *memoryQueue) Pop(count ...int) []string {
+	mq.Lock()
+	defer mq.Unlock()
+	return mq.pop(count...)
+}
+
+func (mq *memoryQueue) pop(count ...int) []string {
+	cnt := 1
+	if len(count) > 0 && count[0] > 0 {
+		cnt = count[0]
+	}
+
+	if size := len(mq.messages); cnt > size {
+		cnt = size
+	}
+
+	msgArr := make([]string, cnt)
+	copy(msgArr, mq.messages[:cnt])
+
+	// release references held by the underlying array
+	for i := 0; i < cnt; i++ {
+		mq.messages[i] = ""
+	}
+	mq.messages = mq.messages[cnt:]
+	if len(mq.messages) == 0 {
+		mq.messages = nil
+	}
+	return msgArr
+}
+
+func (mq *memoryQueue) Size() int {
+	mq.Lock()
+	defer mq.Unlock()
+	return len(mq.messages)
+}
+
+func (mq *memoryQueue) Limit() int {
+	return mq.limit
+}
+
+func (mq *memoryQueue) Reserve(count ...int) []string {
+	mq.Lock()
+	defer mq.Unlock()
+	return mq.reserve(count...)
+}
+
+func (mq *memoryQueue) BReserve(timeout time.Duration, count ...int) []string {
+	mq.waitLocked(timeout)
+	defer mq.Unlock()
+	return mq.reserve(count...)
+}
+
+func (mq *memoryQueue) reserve(count ...int) []string {
+	msgArr := mq.pop(count...)
+	deadline := time.Now().Add(mq.visibility)
+	for _, msg := range msgArr {
+		mq.leases.lease(msg, deadline)
+	}
+	return msgArr
+}
+
+func (mq *memoryQueue) Ack(message string) error {
+	mq.Lock()
+	defer mq.Unlock()
+	return mq.leases.release(message, true)
+}
+
+func (mq *memoryQueue) Nack(message string) error {
+	return mq.nack(message, true)
+}
+
+// Release give message back as Nack does, but its delivery is not counted as an attempt
+func (mq *memoryQueue) Release(message string) error {
+	return mq.nack(message, false)
+}
+
+func (mq *memoryQueue) nack(message string, attempted bool) error {
+	mq.Lock()
+	defer mq.Unlock()
+
+	if err := mq.leases.release(message, false); err != nil {
+		return err
+	}
+	if !attempted {
+		mq.leases.forget(message)
+	}
+	// give it back to the head, so it is the next one to deliver
+	mq.messages = append([]string{message}, mq.messages...)
+	mq.signal()
+	return nil
+}
+
+func (mq *memoryQueue) Requeue() int {
+	mq.Lock()
+	defer mq.Unlock()
+
+	expired := mq.leases.expired(time.Now())
+	if len(expired) > 0 {
+		mq.messages = append(expired, mq.messages...)
+		mq.signal()
+	}
+	return len(expired)
+}
+
+func (mq *memoryQueue) Attempts(message string) int {
+	mq.Lock()
+	defer mq.Unlock()
+	return mq.leases.deliveries(message)
+}
+
+func (mq *memoryQueue) SetVisibility(timeout time.Duration) {
+	mq.Lock()
+	defer mq.Unlock()
+	if timeout > 0 {
+		mq.visibility = timeout
+	}
+}
+
+// Range list messages in pop order without removing them
+func (mq *memoryQueue) Range(offset, limit int) []string {
+	mq.Lock()
+	defer mq.Unlock()
+
+	size := len(mq.messages)
+	if offset < 0 || offset >= size || limit <= 0 {
+		return nil
+	}
+	end := offset + limit
+	if end > size {
+		end = size
+	}
+	msgArr := make([]string, end-offset)
+	copy(msgArr, mq.messages[offset:end])
+	return msgArr
+}
+
+// Remove delete the first queued copy of message
+func (mq *memoryQueue) Remove(message string) error {
+	mq.Lock()
+	defer mq.Unlock()
+
+	for i, msg := range mq.messages {
+		if msg == message {
+			mq.messages = append(mq.messages[:i], mq.messages[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("message not found")
+}
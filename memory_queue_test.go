@@ -0,0 +1,207 @@
+package spider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestMemoryQueueFIFO(t *testing.T) {
+	q := NewMemoryQueue("test", 0)
+	if err := q.Put("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Put("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs := q.Pop(); len(msgs) != 1 || msgs[0] != "a" {
+		t.Fatalf("pop one, got %v", msgs)
+	}
+	if msgs := q.Pop(10); len(msgs) != 2 || msgs[0] != "b" || msgs[1] != "c" {
+		t.Fatalf("pop batch, got %v", msgs)
+	}
+	if msgs := q.Pop(); len(msgs) != 0 {
+		t.Fatalf("pop empty, got %v", msgs)
+	}
+}
+
+func TestMemoryQueueLimit(t *testing.T) {
+	q := NewMemoryQueue("test", 2)
+	if q.Limit() != 2 {
+		t.Fatalf("limit = %d", q.Limit())
+	}
+	if err := q.Put("a", "b", "c"); err == nil {
+		t.Fatal("put over limit should fail")
+	}
+	if err := q.Put("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Put("c"); err != core.ErrQueueFull {
+		t.Fatalf("put into full queue should fail with ErrQueueFull, got %v", err)
+	}
+	if !core.IsCongested(q) {
+		t.Fatal("full queue should be congested")
+	}
+	q.Pop()
+	if err := q.Put("c"); err != nil {
+		t.Fatal(err)
+	}
+	if q.Size() != 2 {
+		t.Fatalf("size = %d", q.Size())
+	}
+}
+
+func TestMemoryQueueConcurrent(t *testing.T) {
+	q := NewMemoryQueue("test", 0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = q.Put(fmt.Sprintf("%d-%d", n, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var seen = map[string]bool{}
+	var mu sync.Mutex
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msgs := q.Pop(7); len(msgs) > 0; msgs = q.Pop(7) {
+				mu.Lock()
+				for _, m := range msgs {
+					seen[m] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != 1000 || q.Size() != 0 {
+		t.Fatalf("seen %d messages, %d left", len(seen), q.Size())
+	}
+}
+
+func TestMemoryQueueAckNack(t *testing.T) {
+	q := NewMemoryQueue("test", 0).(core.IReliableQueue)
+	q.SetVisibility(50 * time.Millisecond)
+	_ = q.Put("a", "b", "c")
+
+	msgs := q.Reserve(2)
+	if len(msgs) != 2 || q.Size() != 1 {
+		t.Fatalf("reserve got %v, size %d", msgs, q.Size())
+	}
+	if err := q.Ack("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack("a"); err == nil {
+		t.Fatal("ack twice should fail")
+	}
+	if err := q.Nack("b"); err != nil {
+		t.Fatal(err)
+	}
+	if msgs = q.Reserve(); len(msgs) != 1 || msgs[0] != "b" {
+		t.Fatalf("nacked message should be delivered first, got %v", msgs)
+	}
+
+	if cnt := q.Requeue(); cnt != 0 {
+		t.Fatalf("lease not expired, requeue %d", cnt)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if cnt := q.Requeue(); cnt != 1 {
+		t.Fatalf("expired lease should requeue 1, got %d", cnt)
+	}
+	if msgs = q.Pop(2); len(msgs) != 2 || msgs[0] != "b" || msgs[1] != "c" {
+		t.Fatalf("got %v", msgs)
+	}
+}
+
+func TestMemoryQueueRelease(t *testing.T) {
+	for _, q := range []core.IQueue{NewMemoryQueue("test", 0), NewMemoryPriorityQueue("test", 0)} {
+		rq := q.(core.IReleasableQueue)
+		_ = rq.Put("a")
+
+		_ = rq.Reserve()
+		if err := rq.Nack("a"); err != nil {
+			t.Fatal(err)
+		}
+		_ = rq.Reserve()
+		if err := rq.Release("a"); err != nil || rq.Size() != 1 {
+			t.Fatalf("released message should go back, got %v", err)
+		}
+		if msgs := rq.Reserve(); len(msgs) != 1 || rq.Attempts("a") != 2 {
+			t.Fatalf("a released delivery should not count, attempts %d", rq.Attempts("a"))
+		}
+		if err := rq.Release("b"); err == nil {
+			t.Fatalf("a message not in flight can not be released")
+		}
+	}
+}
+
+func TestMemoryQueueBlockingPop(t *testing.T) {
+	q := NewMemoryQueue("test", 0).(core.IBlockingReliableQueue)
+
+	start := time.Now()
+	if msgs := q.BReserve(50*time.Millisecond, 2); len(msgs) != 0 || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("empty queue should wait for timeout, got %v", msgs)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = q.Put("a")
+	}()
+	start = time.Now()
+	msgs := q.BReserve(5*time.Second, 2)
+	if len(msgs) != 1 || msgs[0] != "a" || time.Since(start) > time.Second {
+		t.Fatalf("should wake up on put, got %v after %v", msgs, time.Since(start))
+	}
+	if err := q.Ack("a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryPriorityQueue(t *testing.T) {
+	q := NewMemoryPriorityQueue("test", 0).(core.IReliableQueue)
+
+	message := func(url string, priority int) string {
+		task := core.NewTask(url)
+		task.Schedule.Priority = priority
+		bytes, _ := json.Marshal(core.Schedule2FetchMessage{Task: task})
+		return string(bytes)
+	}
+	list1, list2 := message("list1", core.DefaultPriority), message("list2", core.DefaultPriority)
+	detail, login := message("detail", 7), message("login", 9)
+	_ = q.Put(list1, list2, detail, login)
+
+	msgs := q.Reserve(2)
+	if len(msgs) != 2 || msgs[0] != login || msgs[1] != detail {
+		t.Fatalf("higher priority should go first, got %v", msgs)
+	}
+	if err := q.Nack(detail); err != nil {
+		t.Fatal(err)
+	}
+	if msgs = q.Pop(3); len(msgs) != 3 || msgs[0] != detail || msgs[1] != list1 || msgs[2] != list2 {
+		t.Fatalf("same priority should keep put order, got %v", msgs)
+	}
+
+	list3 := message("list3", core.DefaultPriority)
+	_ = q.Put(list1, list2, list3)
+	msgs = q.Reserve(2)
+	_ = q.Nack(list2)
+	_ = q.Nack(list1)
+	if msgs = q.Pop(3); len(msgs) != 3 || msgs[0] != list1 || msgs[1] != list2 || msgs[2] != list3 {
+		t.Fatalf("requeued messages should keep put order, got %v", msgs)
+	}
+}
@@ -0,0 +1,65 @@
+package spider
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+import (
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.IRateLimiter = &memoryRateLimiter{}
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryRateLimiter keeps the buckets in process, it limits one scheduler only
+type memoryRateLimiter struct {
+	sync.Mutex
+
+	buckets map[string]*tokenBucket
+}
+
+func NewMemoryRateLimiter() core.IRateLimiter {
+	return &memoryRateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+func (ml *memoryRateLimiter) Reserve(keys []string, limits []core.RateLimit) (time.Duration, error) {
+	ml.Lock()
+	defer ml.Unlock()
+
+	now := time.Now()
+	var buckets []*tokenBucket
+	var wait float64
+	for i, key := range keys {
+		limit := limits[i]
+		if limit.Unlimited() {
+			continue
+		}
+		capacity := float64(limit.Capacity())
+		b, ok := ml.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: capacity, last: now}
+			ml.buckets[key] = b
+		}
+		if now.After(b.last) {
+			b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*limit.QPS)
+			b.last = now
+		}
+		if b.tokens < 1 {
+			wait = math.Max(wait, (1-b.tokens)/limit.QPS)
+		}
+		buckets = append(buckets, b)
+	}
+
+	// taken together, so a task refused by one bucket never wastes the token of another
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return time.Duration(math.Ceil(wait * float64(time.Second))), nil
+}
@@ -0,0 +1,117 @@
+package spider
+
+import (
+	"encoding/json"
+	"sync"
+)
+import (
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.ITaskStore = &memoryTaskStore{}
+)
+
+type taskKey struct {
+	project string
+	taskId  string
+}
+
+// memoryTaskStore is an in-process ITaskStore, tasks are kept encoded so callers never share them
+type memoryTaskStore struct {
+	sync.RWMutex
+
+	projects map[string]map[string][]byte
+	recrawl  map[taskKey]int64 // next crawl time of the auto recrawl tasks
+}
+
+func NewMemoryTaskStore() core.ITaskStore {
+	return &memoryTaskStore{projects: map[string]map[string][]byte{}, recrawl: map[taskKey]int64{}}
+}
+
+func (ms *memoryTaskStore) Get(project, taskId string) (*core.Task, bool) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	if data, ok := ms.projects[project][taskId]; ok {
+		task := &core.Task{}
+		if err := json.Unmarshal(data, task); err == nil {
+			return task, true
+		}
+	}
+	return nil, false
+}
+
+func (ms *memoryTaskStore) Save(task *core.Task) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.save(task, data)
+	return nil
+}
+
+func (ms *memoryTaskStore) Update(project, taskId string, change func(task *core.Task) bool) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	old, ok := ms.projects[project][taskId]
+	if !ok {
+		return nil
+	}
+	task := &core.Task{}
+	if err := json.Unmarshal(old, task); err != nil {
+		return err
+	}
+	if !change(task) {
+		return nil
+	}
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	ms.save(task, data)
+	return nil
+}
+
+// save must be called with the lock held
+func (ms *memoryTaskStore) save(task *core.Task, data []byte) {
+	tasks, ok := ms.projects[task.Project]
+	if !ok {
+		tasks = map[string][]byte{}
+		ms.projects[task.Project] = tasks
+	}
+	tasks[task.TaskId] = data
+
+	key := taskKey{project: task.Project, taskId: task.TaskId}
+	if next := task.NextCrawl(); next > 0 {
+		ms.recrawl[key] = next
+	} else {
+		delete(ms.recrawl, key)
+	}
+}
+
+func (ms *memoryTaskStore) DueRecrawl(now int64, lease int64, count int) []*core.Task {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var tasks []*core.Task
+	for key, next := range ms.recrawl {
+		if len(tasks) >= count {
+			break
+		}
+		if next > now {
+			continue
+		}
+		task := &core.Task{}
+		if err := json.Unmarshal(ms.projects[key.project][key.taskId], task); err == nil {
+			ms.recrawl[key] = now + lease
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
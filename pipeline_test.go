@@ -0,0 +1,148 @@
+package spider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	"github.com/xgo11/spider/components/fetcher"
+	"github.com/xgo11/spider/components/processor"
+	"github.com/xgo11/spider/components/result_worker"
+	"github.com/xgo11/spider/components/scheduler"
+	"github.com/xgo11/spider/core"
+)
+
+func TestPipelineWithMemoryQueue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			_, _ = fmt.Fprint(w, `<html><body><a href="/detail">detail</a></body></html>`)
+		case "/detail":
+			_, _ = fmt.Fprint(w, `<html><body><h1>hello</h1></body></html>`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	results := make(chan *core.Result, 1)
+
+	builder := newProject("pipeline_test")
+	builder.AddCallback(core.ProcessCallback{
+		Name: "index",
+		Callback: func(task *core.Task, resp *core.Response) ([]*core.Task, *core.Result) {
+			var tasks []*core.Task
+			resp.GetDocument().Find("a").Each(func(i int, s *goquery.Selection) {
+				href, _ := s.Attr("href")
+				tasks = append(tasks, UrlTask(server.URL+href, map[string]interface{}{"callback": "detail"}))
+			})
+			return tasks, nil
+		},
+	})
+	builder.AddCallback(core.ProcessCallback{
+		Name: "detail",
+		Callback: func(task *core.Task, resp *core.Response) ([]*core.Task, *core.Result) {
+			ret := BuildResult(resp)
+			ret.Parsed = []byte(resp.GetDocument().Find("h1").Text())
+			return nil, ret
+		},
+	})
+	builder.AddResultWorkerHook(core.ResultWorkerHook{
+		Hook: core.Hook{Name: "collect"},
+		OnResult: func(task *core.Task, ret *core.Result) {
+			results <- ret
+		},
+	})
+	builder.RegisterMe()
+
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+	f2pQ := NewMemoryQueue("f2p", 0)
+	p2rQ := NewMemoryQueue("p2r", 0)
+	statusQ := NewMemoryQueue("status", 0)
+
+	s := scheduler.NewScheduler(newQ, s2fQ, statusQ)
+	f := fetcher.NewFetcher(s2fQ, f2pQ, statusQ)
+	p := processor.NewProcessor(newQ, f2pQ, p2rQ, statusQ)
+	r := result_worker.NewResultWorker(p2rQ, statusQ)
+
+	defer start(s, f, p, r)()
+
+	task := UrlTask(server.URL+"/", map[string]interface{}{"callback": "index"})
+	task.Project = builder.GetName()
+	putTask(t, newQ, task)
+
+	select {
+	case ret := <-results:
+		if ret.ErrCode != http.StatusOK || string(ret.Parsed) != "hello" {
+			t.Fatalf("unexpected result: %+v", ret)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for result")
+	}
+}
+
+// every stage is bounded, and every page fans out new tasks, the stages must not wait on each other in a cycle
+func TestPipelineWithBoundedQueues(t *testing.T) {
+	const pages = 63 // a binary tree of pages, /n links to /2n+1 and /2n+2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	results := make(chan *core.Result, pages)
+
+	builder := newProject("bounded_pipeline_test")
+	builder.AddCallback(core.ProcessCallback{
+		Name: "page",
+		Callback: func(task *core.Task, resp *core.Response) ([]*core.Task, *core.Result) {
+			var n int
+			_, _ = fmt.Sscanf(resp.GetText(), "/%d", &n)
+			var tasks []*core.Task
+			for _, child := range []int{2*n + 1, 2*n + 2} {
+				if child < pages {
+					tasks = append(tasks, UrlTask(fmt.Sprintf("%s/%d", server.URL, child), map[string]interface{}{"callback": "page"}))
+				}
+			}
+			return tasks, BuildResult(resp)
+		},
+	})
+	builder.AddResultWorkerHook(core.ResultWorkerHook{
+		Hook: core.Hook{Name: "collect"},
+		OnResult: func(task *core.Task, ret *core.Result) {
+			results <- ret
+		},
+	})
+	builder.RegisterMe()
+
+	newQ := NewMemoryQueue("new", 4)
+	s2fQ := NewMemoryQueue("s2f", 4)
+	f2pQ := NewMemoryQueue("f2p", 4)
+	p2rQ := NewMemoryQueue("p2r", 0)
+
+	s := scheduler.NewScheduler(newQ, s2fQ, nil)
+	core.SetDelayStore(s, NewMemoryDelayStore())
+	f := fetcher.NewFetcher(s2fQ, f2pQ, nil)
+	p := processor.NewProcessor(newQ, f2pQ, p2rQ, nil)
+	r := result_worker.NewResultWorker(p2rQ, nil)
+
+	defer start(s, f, p, r)()
+
+	task := UrlTask(server.URL+"/0", map[string]interface{}{"callback": "page"})
+	task.Project = builder.GetName()
+	putTask(t, newQ, task)
+
+	timeout := time.After(60 * time.Second)
+	for i := 0; i < pages; i++ {
+		select {
+		case <-results:
+		case <-timeout:
+			t.Fatalf("pipeline stalled after %d of %d pages, new=%d s2f=%d f2p=%d", i, pages, newQ.Size(), s2fQ.Size(), f2pQ.Size())
+		}
+	}
+}
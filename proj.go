@@ -10,8 +10,12 @@ import (
 
 //ensure interface
 var (
-	_ core.IProject        = &standardProject{}
-	_ core.IProjectBuilder = &standardProject{}
+	_ core.IProject         = &standardProject{}
+	_ core.IProjectBuilder  = &standardProject{}
+	_ core.IRetryConfigured = &standardProject{}
+	_ core.IRetryScheduled  = &standardProject{}
+	_ core.ITLSConfigured   = &standardProject{}
+	_ core.IBodyConfigured  = &standardProject{}
 )
 
 type standardProject struct {
@@ -26,6 +30,10 @@ type standardProject struct {
 	pHArr  []core.ProcessHook
 	rHArr  []core.ResultWorkerHook
 	idFunc core.TaskIdFunc
+	retry  *core.RetryPolicy
+	retryS *core.RetrySchedule
+	tls    *core.TLSConfig
+	body   *core.BodyPolicy
 }
 
 func NewProjectBuilder(projectName string) core.IProjectBuilder {
@@ -160,3 +168,59 @@ func (sp *standardProject) AddTaskIdFunc(idFunc core.TaskIdFunc) {
 
 	sp.idFunc = idFunc
 }
+
+func (sp *standardProject) SetRetryPolicy(policy core.RetryPolicy) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	sp.retry = &policy
+}
+
+func (sp *standardProject) GetRetryPolicy() *core.RetryPolicy {
+	sp.RLock()
+	defer sp.RUnlock()
+
+	return sp.retry
+}
+
+func (sp *standardProject) SetRetrySchedule(schedule core.RetrySchedule) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	sp.retryS = &schedule
+}
+
+func (sp *standardProject) GetRetrySchedule() *core.RetrySchedule {
+	sp.RLock()
+	defer sp.RUnlock()
+
+	return sp.retryS
+}
+
+func (sp *standardProject) SetTLSConfig(conf core.TLSConfig) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	sp.tls = &conf
+}
+
+func (sp *standardProject) GetTLSConfig() *core.TLSConfig {
+	sp.RLock()
+	defer sp.RUnlock()
+
+	return sp.tls
+}
+
+func (sp *standardProject) SetBodyPolicy(policy core.BodyPolicy) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	sp.body = &policy
+}
+
+func (sp *standardProject) GetBodyPolicy() *core.BodyPolicy {
+	sp.RLock()
+	defer sp.RUnlock()
+
+	return sp.body
+}
@@ -0,0 +1,31 @@
+package spider
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestProjectTLSConfig(t *testing.T) {
+	conf := core.TLSConfig{CAFile: "ca.pem", CertFile: "cert.pem", KeyFile: "key.pem", MinVersion: "1.2"}
+	builder := newProject("tls_test")
+	builder.(core.ITLSConfigured).SetTLSConfig(conf)
+	builder.RegisterMe()
+
+	task := UrlTask("https://localhost/", nil)
+	task.Project = builder.GetName()
+	if got := core.TaskTLSConfig(task); got != conf {
+		t.Fatalf("should take the config of the project, got %+v", got)
+	}
+
+	// the config of the task replaces the one of the project
+	task.Fetch.TLS = &core.TLSConfig{Insecure: true}
+	if got := core.TaskTLSConfig(task); got != *task.Fetch.TLS {
+		t.Fatalf("should take the config of the task as a whole, got %+v", got)
+	}
+	if got := core.TaskTLSConfig(UrlTask("https://localhost/", nil)); got != (core.TLSConfig{}) {
+		t.Fatalf("should verify by default, got %+v", got)
+	}
+}
@@ -0,0 +1,279 @@
+package spider
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+import (
+	"github.com/xgo11/spider/core"
+)
+
+// how the proxy pool assigns proxies
+const (
+	ProxyRoundRobin    = "round_robin"    // one after another
+	ProxyStickyHost    = "sticky_host"    // the same one for a host, as long as it is healthy
+	ProxyLeastFailures = "least_failures" // the one failing the least
+)
+
+var (
+	_ core.IProxyPool = &proxyPool{}
+)
+
+var (
+	proxyMaxFailures = 5                // a proxy failing so many times in a row is evicted
+	proxyEvictTime   = 5 * time.Minute  // for so long
+	proxyMaxSticky   = 10000            // hosts kept by ProxyStickyHost, the least recently used are forgotten
+	proxyStickyIdle  = 30 * time.Minute // a host not fetched for so long is forgotten
+)
+
+type proxyEntry struct {
+	proxy        string
+	successes    int
+	failures     int
+	streak       int // failures in a row
+	evictedUntil time.Time
+}
+
+func (e *proxyEntry) failureRatio() float64 {
+	return float64(e.failures+1) / float64(e.successes+e.failures+2)
+}
+
+type stickyProxy struct {
+	proxy    string
+	lastUsed time.Time
+}
+
+type proxyPool struct {
+	sync.Mutex
+
+	strategy string
+	entries  []*proxyEntry
+	byProxy  map[string]*proxyEntry
+	sticky   map[string]*stickyProxy // by host
+	next     int
+}
+
+// NewProxyPool create a pool assigning proxies by strategy, ProxyRoundRobin when it is unknown
+func NewProxyPool(strategy string, proxies ...string) core.IProxyPool {
+	switch strategy {
+	case ProxyRoundRobin, ProxyStickyHost, ProxyLeastFailures:
+	default:
+		strategy = ProxyRoundRobin
+	}
+	pool := &proxyPool{strategy: strategy, byProxy: map[string]*proxyEntry{}, sticky: map[string]*stickyProxy{}}
+	pool.Update(proxies)
+	return pool
+}
+
+func (pool *proxyPool) Update(proxies []string) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	byProxy := make(map[string]*proxyEntry, len(proxies))
+	entries := make([]*proxyEntry, 0, len(proxies))
+	for _, proxy := range proxies {
+		if proxy = strings.TrimSpace(proxy); proxy == "" || byProxy[proxy] != nil {
+			continue
+		}
+		entry, ok := pool.byProxy[proxy]
+		if !ok {
+			entry = &proxyEntry{proxy: proxy}
+		}
+		byProxy[proxy] = entry
+		entries = append(entries, entry)
+	}
+
+	for host, s := range pool.sticky {
+		if byProxy[s.proxy] == nil {
+			delete(pool.sticky, host)
+		}
+	}
+	pool.entries, pool.byProxy = entries, byProxy
+}
+
+func (pool *proxyPool) Get(task *core.Task) string {
+	pool.Lock()
+	defer pool.Unlock()
+
+	now := time.Now()
+	candidates := pool.healthyLocked(now)
+	if len(candidates) < 1 {
+		return ""
+	}
+
+	switch pool.strategy {
+	case ProxyStickyHost:
+		host := core.TaskHost(task)
+		if s, ok := pool.sticky[host]; ok {
+			for _, e := range candidates {
+				if e.proxy == s.proxy {
+					s.lastUsed = now
+					return s.proxy
+				}
+			}
+		} else if len(pool.sticky) >= proxyMaxSticky {
+			pool.forgetStickyLocked(now)
+		}
+		proxy := pool.roundRobinLocked(candidates).proxy
+		pool.sticky[host] = &stickyProxy{proxy: proxy, lastUsed: now}
+		return proxy
+
+	case ProxyLeastFailures:
+		start := pool.next % len(candidates)
+		pool.next++
+		best := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			if e := candidates[(start+i)%len(candidates)]; e.failureRatio() < best.failureRatio() {
+				best = e
+			}
+		}
+		return best.proxy
+
+	default:
+		return pool.roundRobinLocked(candidates).proxy
+	}
+}
+
+func (pool *proxyPool) roundRobinLocked(candidates []*proxyEntry) *proxyEntry {
+	e := candidates[pool.next%len(candidates)]
+	pool.next++
+	return e
+}
+
+// forgetStickyLocked drop the idle hosts, or the least recently used one when none is idle
+func (pool *proxyPool) forgetStickyLocked(now time.Time) {
+	var oldest string
+	var oldestTime time.Time
+	for host, s := range pool.sticky {
+		if now.Sub(s.lastUsed) >= proxyStickyIdle {
+			delete(pool.sticky, host)
+		} else if oldestTime.IsZero() || s.lastUsed.Before(oldestTime) {
+			oldest, oldestTime = host, s.lastUsed
+		}
+	}
+	if len(pool.sticky) >= proxyMaxSticky {
+		delete(pool.sticky, oldest)
+	}
+}
+
+// healthyLocked returns the proxies not evicted, or all of them when every one is evicted,
+// a bad proxy is still better than sending the requests without one
+func (pool *proxyPool) healthyLocked(now time.Time) []*proxyEntry {
+	healthy := make([]*proxyEntry, 0, len(pool.entries))
+	for _, e := range pool.entries {
+		if !e.evictedUntil.IsZero() && !now.Before(e.evictedUntil) { // a second chance
+			e.evictedUntil, e.streak = time.Time{}, 0
+		}
+		if e.evictedUntil.IsZero() {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) < 1 {
+		return pool.entries
+	}
+	return healthy
+}
+
+func (pool *proxyPool) Report(proxy string, ok bool) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	e, exists := pool.byProxy[proxy]
+	if !exists {
+		return
+	}
+	if ok {
+		e.successes++
+		e.streak = 0
+		return
+	}
+
+	e.failures++
+	if e.streak++; e.streak >= proxyMaxFailures && e.evictedUntil.IsZero() {
+		e.evictedUntil = time.Now().Add(proxyEvictTime)
+		logger.WithField("proxy", proxy).WithField("failures", e.streak).Warn("evict proxy")
+	}
+}
+
+func (pool *proxyPool) Stats() []core.ProxyStat {
+	pool.Lock()
+	defer pool.Unlock()
+
+	stats := make([]core.ProxyStat, 0, len(pool.entries))
+	for _, e := range pool.entries {
+		stats = append(stats, core.ProxyStat{
+			Proxy:     e.proxy,
+			Successes: e.successes,
+			Failures:  e.failures,
+			Evicted:   !e.evictedUntil.IsZero(),
+		})
+	}
+	return stats
+}
+
+// ReloadProxies load the proxies of source into pool every interval, until stop is called, a pool never
+// reloads by itself. A failed or empty load keeps the proxies the pool has.
+func ReloadProxies(pool core.IProxyPool, source string, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				proxies, err := LoadProxies(source)
+				if err != nil || len(proxies) == 0 {
+					logger.WithError(err).WithField("source", source).Error("reload proxies fail")
+					continue
+				}
+				pool.Update(proxies)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// LoadProxies read proxies from a http(s) url or a file, one per line, blank lines and lines starting with # are skipped
+func LoadProxies(source string) ([]string, error) {
+	var content []byte
+	var err error
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 30 * time.Second}
+		var resp *http.Response
+		if resp, err = client.Get(source); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("load proxies from %v: status %v", source, resp.StatusCode)
+		}
+		content, err = ioutil.ReadAll(resp.Body)
+	} else {
+		content, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var proxies []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			proxies = append(proxies, line)
+		}
+	}
+	return proxies, scanner.Err()
+}
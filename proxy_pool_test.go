@@ -0,0 +1,119 @@
+package spider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestProxyPoolStrategies(t *testing.T) {
+	hostA, hostB := core.NewTask("http://a.com/1"), core.NewTask("http://b.com/1")
+
+	rr := NewProxyPool(ProxyRoundRobin, "p1", "p2", "p3")
+	if got := []string{rr.Get(hostA), rr.Get(hostA), rr.Get(hostA), rr.Get(hostA)}; strings.Join(got, ",") != "p1,p2,p3,p1" {
+		t.Fatalf("round robin got %v", got)
+	}
+
+	sticky := NewProxyPool(ProxyStickyHost, "p1", "p2")
+	a, b := sticky.Get(hostA), sticky.Get(hostB)
+	if a == b || sticky.Get(hostA) != a || sticky.Get(hostB) != b {
+		t.Fatalf("sticky host got a=%v b=%v", a, b)
+	}
+
+	least := NewProxyPool(ProxyLeastFailures, "p1", "p2")
+	least.Report("p1", false)
+	least.Report("p2", true)
+	for i := 0; i < 3; i++ {
+		if got := least.Get(hostA); got != "p2" {
+			t.Fatalf("least failures got %v", got)
+		}
+	}
+}
+
+func TestProxyPoolEviction(t *testing.T) {
+	task := core.NewTask("http://a.com/1")
+	pool := NewProxyPool(ProxyStickyHost, "p1", "p2")
+	bad := pool.Get(task)
+	for i := 0; i < proxyMaxFailures; i++ {
+		pool.Report(bad, false)
+	}
+	for i := 0; i < 3; i++ {
+		if got := pool.Get(task); got == bad {
+			t.Fatalf("evicted proxy %v should not be assigned", bad)
+		}
+	}
+
+	pool.Update([]string{bad})
+	if got := pool.Get(task); got != bad {
+		t.Fatalf("the only proxy should be used even evicted, got %v", got)
+	}
+	if stats := pool.Stats(); len(stats) != 1 || !stats[0].Evicted || stats[0].Failures != proxyMaxFailures {
+		t.Fatalf("scores should be kept on update, got %+v", stats)
+	}
+}
+
+func TestProxyPoolStickyHostsBounded(t *testing.T) {
+	defer func(max int) { proxyMaxSticky = max }(proxyMaxSticky)
+	proxyMaxSticky = 2
+
+	pool := NewProxyPool(ProxyStickyHost, "p1", "p2").(*proxyPool)
+	for _, host := range []string{"a.com", "b.com", "a.com", "c.com"} {
+		pool.Get(core.NewTask("http://" + host + "/1"))
+	}
+	if _, ok := pool.sticky["b.com"]; len(pool.sticky) != 2 || ok {
+		t.Fatalf("the least recently used host should be forgotten, got %v", pool.sticky)
+	}
+}
+
+func TestReloadProxies(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "proxies")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxies.txt")
+	_ = ioutil.WriteFile(path, []byte("p1\np2\n"), 0644)
+
+	pool := NewProxyPool(ProxyRoundRobin, "p0")
+	stop := ReloadProxies(pool, path, 10*time.Millisecond)
+	defer stop()
+	for i := 0; i < 50 && len(pool.Stats()) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := pool.Stats(); len(stats) != 2 || stats[0].Proxy != "p1" {
+		t.Fatalf("proxies should be reloaded, got %+v", stats)
+	}
+
+	_ = os.Remove(path)
+	time.Sleep(50 * time.Millisecond)
+	if stats := pool.Stats(); len(stats) != 2 {
+		t.Fatalf("a failed load should keep the proxies, got %+v", stats)
+	}
+}
+
+func TestLoadProxies(t *testing.T) {
+	content := "# proxies\n127.0.0.1:8001\n\n  http://127.0.0.1:8002  \n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "proxies")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxies.txt")
+	_ = ioutil.WriteFile(path, []byte(content), 0644)
+
+	for _, source := range []string{server.URL, path} {
+		proxies, err := LoadProxies(source)
+		if err != nil || len(proxies) != 2 || proxies[1] != "http://127.0.0.1:8002" {
+			t.Fatalf("load from %v got %v, %v", source, proxies, err)
+		}
+	}
+}
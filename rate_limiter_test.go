@@ -0,0 +1,172 @@
+package spider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/components/scheduler"
+	"github.com/xgo11/spider/core"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	l := NewMemoryRateLimiter()
+	limit := core.RateLimit{QPS: 10, Burst: 2}
+	hostA := []string{"host:a"}
+	limits := []core.RateLimit{limit}
+
+	for i := 0; i < 2; i++ {
+		if wait, _ := l.Reserve(hostA, limits); wait != 0 {
+			t.Fatalf("burst token %d should be taken, wait %v", i, wait)
+		}
+	}
+	wait, _ := l.Reserve(hostA, limits)
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("empty bucket should wait for the next token, wait %v", wait)
+	}
+	if next, _ := l.Reserve(hostA, limits); next <= wait || next > 200*time.Millisecond {
+		t.Fatalf("reservations should be staggered, wait %v after %v", next, wait)
+	}
+	if w, _ := l.Reserve([]string{"host:b"}, limits); w != 0 {
+		t.Fatalf("buckets should be kept by key, wait %v", w)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if wait, _ = l.Reserve(hostA, limits); wait != 0 {
+		t.Fatalf("token should be refilled, wait %v", wait)
+	}
+}
+
+func TestMemoryRateLimiterReservesAllBuckets(t *testing.T) {
+	l := NewMemoryRateLimiter()
+	host := core.RateLimit{QPS: 10, Burst: 2}
+	project := core.RateLimit{QPS: 10, Burst: 1}
+
+	_, _ = l.Reserve([]string{"project:p"}, []core.RateLimit{project})
+	wait, _ := l.Reserve([]string{"host:a", "project:p"}, []core.RateLimit{host, project})
+	if wait <= 0 {
+		t.Fatalf("an empty project bucket should hold the task, wait %v", wait)
+	}
+	if w, _ := l.Reserve([]string{"host:a"}, []core.RateLimit{host}); w != 0 {
+		t.Fatalf("the host bucket should keep its second token, wait %v", w)
+	}
+}
+
+func TestSchedulerRateLimit(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+	delayStore := NewMemoryDelayStore()
+
+	s := scheduler.NewScheduler(newQ, s2fQ, nil)
+	core.SetDelayStore(s, delayStore)
+	core.SetRateLimiter(s, NewMemoryRateLimiter(), core.RateLimitConfig{
+		Host:  core.RateLimit{QPS: 0.5, Burst: 2},
+		Hosts: map[string]core.RateLimit{"fast.localhost": {}},
+	})
+	defer start(s)()
+
+	for i := 0; i < 5; i++ {
+		for _, host := range []string{"slow.localhost", "fast.localhost"} {
+			putTask(t, newQ, UrlTask(fmt.Sprintf("http://%s/%d", host, i), nil))
+		}
+	}
+
+	waitFor(time.Second, func() bool { return s2fQ.Size() >= 7 })
+	if s2fQ.Size() != 7 || delayStore.Size() != 3 {
+		t.Fatalf("slow host should dispatch its burst only, dispatched %d, delayed %d", s2fQ.Size(), delayStore.Size())
+	}
+}
+
+// the delay store counts in seconds, the tokens falling due within one must not be released together
+func TestSchedulerRateLimitSpacesDelayedTasks(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+
+	var mu sync.Mutex
+	var selected []time.Time
+	s := scheduler.NewScheduler(newQ, s2fQ, nil, core.SchedulerHook{
+		Hook: core.Hook{Name: "clock"},
+		OnTaskSelect: func(task *core.Task) {
+			mu.Lock()
+			defer mu.Unlock()
+			selected = append(selected, time.Now())
+		},
+	})
+	core.SetDelayStore(s, NewMemoryDelayStore())
+	core.SetRateLimiter(s, NewMemoryRateLimiter(), core.RateLimitConfig{Host: core.RateLimit{QPS: 2, Burst: 1}})
+	defer start(s)()
+
+	for i := 0; i < 4; i++ {
+		putTask(t, newQ, UrlTask(fmt.Sprintf("http://localhost/%d", i), nil))
+	}
+	if !waitFor(5*time.Second, func() bool { return s2fQ.Size() == 4 }) {
+		t.Fatalf("every task should be dispatched, dispatched %d", s2fQ.Size())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i < len(selected); i++ {
+		if gap := selected[i].Sub(selected[i-1]); gap < 400*time.Millisecond {
+			t.Fatalf("the tasks should be dispatched 500ms apart, got %v between %d and %d", gap, i-1, i)
+		}
+	}
+}
+
+func TestSchedulerRateLimitRecrawl(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+	delayStore := NewMemoryDelayStore()
+	store := NewMemoryTaskStore()
+
+	s := scheduler.NewScheduler(newQ, s2fQ, nil)
+	core.SetDelayStore(s, delayStore)
+	core.SetTaskStore(s, store)
+	core.SetRateLimiter(s, NewMemoryRateLimiter(), core.RateLimitConfig{Host: core.RateLimit{QPS: 0.1, Burst: 1}})
+	defer start(s)()
+
+	task := UrlTask("http://localhost/recrawl", nil)
+	task.Project = "rate_limit_test"
+	task.TaskId = "recrawl"
+	task.Schedule.AutoRecrawl = true
+	task.Schedule.Age = 1
+	putTask(t, newQ, task)
+
+	if !waitFor(6*time.Second, func() bool { return delayStore.Size() == 1 }) {
+		t.Fatalf("the recrawl should be throttled, dispatched %d", s2fQ.Size())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if tsk, _ := store.Get(task.Project, task.TaskId); tsk.Schedule.Reserved != 0 {
+		t.Fatalf("only the delayed copy should hold the tokens, stored %+v", tsk.Schedule)
+	}
+	delayed := core.Task{}
+	if msgs := delayStore.PopDue(1<<40, 1); len(msgs) != 1 || json.Unmarshal([]byte(msgs[0]), &delayed) != nil ||
+		delayed.Schedule.Reserved == 0 {
+		t.Fatalf("the delayed copy should hold the tokens, got %v", msgs)
+	}
+}
+
+func TestSchedulerRateLimitWaitEndsOnShutdown(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+
+	s := scheduler.NewScheduler(newQ, s2fQ, nil)
+	core.SetRateLimiter(s, NewMemoryRateLimiter(), core.RateLimitConfig{Host: core.RateLimit{QPS: 0.01, Burst: 1}})
+	stop := start(s)
+
+	putTask(t, newQ, UrlTask("http://localhost/1", nil))
+	putTask(t, newQ, UrlTask("http://localhost/2", nil))
+	waitFor(time.Second, func() bool { return s2fQ.Size() == 1 && newQ.Size() == 0 })
+
+	begin := time.Now()
+	stop()
+	if time.Since(begin) > 3*time.Second {
+		t.Fatalf("shutdown should end the wait for the tokens, took %v", time.Since(begin))
+	}
+	if msgs := newQ.(core.IReliableQueue).Reserve(); len(msgs) != 1 || newQ.(core.IReliableQueue).Attempts(msgs[0]) != 1 {
+		t.Fatalf("the throttled task should be given back untouched, got %v", msgs)
+	}
+}
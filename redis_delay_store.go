@@ -0,0 +1,68 @@
+package spider
+
+import (
+	"fmt"
+)
+import (
+	"github.com/go-redis/redis"
+	"github.com/xgo11/redis4g"
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.IDelayStore = &redisDelayStore{}
+)
+
+var (
+	// KEYS: zset; ARGV: now, count
+	popDueScript = redis.NewScript(`
+local messages = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+if #messages > 0 then
+	redis.call('ZREM', KEYS[1], unpack(messages))
+end
+return messages
+`)
+)
+
+// redisDelayStore keeps messages in a sorted set scored by their due time,
+// identical messages are stored once with the latest due time
+type redisDelayStore struct {
+	name   string
+	zName  string
+	client *redis4g.WrapClient
+}
+
+func NewRedisDelayStore(name string, confPath string) core.IDelayStore {
+	client := redis4g.Connect(confPath)
+	if client == nil {
+		panic(fmt.Sprintf("connect delay store %v fail", confPath))
+	}
+	return &redisDelayStore{name: name, zName: "sys:delay:" + name, client: client}
+}
+
+func (rs *redisDelayStore) Add(message string, due int64) error {
+	key := rs.client.TransformKey(rs.zName)
+	return rs.client.Conn().ZAdd(key, redis.Z{Score: float64(due), Member: message}).Err()
+}
+
+func (rs *redisDelayStore) PopDue(now int64, count int) []string {
+	ret, err := popDueScript.Run(rs.client.Conn(), rs.client.TransformKeyList(rs.zName), now, count).Result()
+	if err != nil {
+		logger.WithError(err).WithField("store", rs.name).Error("pop due fail")
+		return nil
+	}
+
+	items, _ := ret.([]interface{})
+	messages := make([]string, 0, len(items))
+	for _, it := range items {
+		if msg, ok := it.(string); ok {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func (rs *redisDelayStore) Size() int {
+	size, _ := rs.client.Conn().ZCard(rs.client.TransformKey(rs.zName)).Result()
+	return int(size)
+}
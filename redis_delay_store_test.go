@@ -0,0 +1,25 @@
+package spider
+
+import (
+	"testing"
+)
+
+func TestRedisDelayStore(t *testing.T) {
+	ds := NewRedisDelayStore("test:"+t.Name(), redisConf(t)).(*redisDelayStore)
+	ds.client.Delete(ds.zName)
+
+	_ = ds.Add("later", 300)
+	_ = ds.Add("first", 100)
+	_ = ds.Add("second", 200)
+	_ = ds.Add("first", 150) // stored once, at its latest due time
+
+	if msgs := ds.PopDue(99, 10); len(msgs) != 0 {
+		t.Fatalf("nothing is due, got %v", msgs)
+	}
+	if msgs := ds.PopDue(200, 1); len(msgs) != 1 || msgs[0] != "first" || ds.Size() != 2 {
+		t.Fatalf("should pop the earliest due only, got %v", msgs)
+	}
+	if msgs := ds.PopDue(200, 10); len(msgs) != 1 || msgs[0] != "second" || ds.Size() != 1 {
+		t.Fatalf("should pop what is due, got %v", msgs)
+	}
+}
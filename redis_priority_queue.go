@@ -0,0 +1,385 @@
+package spider
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+import (
+	"github.com/go-redis/redis"
+	"github.com/xgo11/redis4g"
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.IQueue                 = &redisPriorityQueue{}
+	_ core.IReliableQueue         = &redisPriorityQueue{}
+	_ core.IBlockingQueue         = &redisPriorityQueue{}
+	_ core.IBlockingReliableQueue = &redisPriorityQueue{}
+	_ core.IReleasableQueue       = &redisPriorityQueue{}
+)
+
+var (
+	// KEYS: the signal list, then the level lists, the lowest first; ARGV: limit, then the level and the message
+	// of every message; a token is left in the signal list for BReserve, the tokens are capped as they are only
+	// wake-ups, a consumer finding none of them still reserves at its next round
+	priorityPutScript = redis.NewScript(`
+if tonumber(ARGV[1]) > 0 then
+	local size = 0
+	for i = 2, #KEYS do
+		size = size + redis.call('LLEN', KEYS[i])
+	end
+	if size + (#ARGV - 1) / 2 > tonumber(ARGV[1]) then
+		return -1
+	end
+end
+for i = 2, #ARGV, 2 do
+	redis.call('LPUSH', KEYS[tonumber(ARGV[i]) + 2], ARGV[i + 1])
+end
+redis.call('LPUSH', KEYS[1], '1')
+redis.call('LTRIM', KEYS[1], 0, 99)
+return (#ARGV - 1) / 2
+`)
+
+	// KEYS: inflight counter hash, lease zset, attempts hash, level hash, the level lists;
+	// ARGV: level, count, deadline
+	priorityReserveScript = redis.NewScript(`
+local out = {}
+local function lease(msg)
+	redis.call('HINCRBY', KEYS[1], msg, 1)
+	redis.call('HINCRBY', KEYS[3], msg, 1)
+	redis.call('ZADD', KEYS[2], ARGV[3], msg)
+	redis.call('HSET', KEYS[4], msg, ARGV[1])
+	out[#out + 1] = msg
+end
+local list = KEYS[5 + tonumber(ARGV[1])]
+for i = 1, tonumber(ARGV[2]) do
+	local msg = redis.call('RPOP', list)
+	if not msg then
+		break
+	end
+	lease(msg)
+end
+return out
+`)
+
+	// KEYS: as priorityReserveScript; ARGV: message, release mode
+	priorityReleaseScript = redis.NewScript(`
+local left = redis.call('HINCRBY', KEYS[1], ARGV[1], -1)
+if left < 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	return -1
+end
+if ARGV[2] == '2' then
+	redis.call('HINCRBY', KEYS[3], ARGV[1], -1)
+end
+local list = KEYS[5 + tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or '0')]
+if left == 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('ZREM', KEYS[2], ARGV[1])
+	redis.call('HDEL', KEYS[4], ARGV[1])
+	if ARGV[2] == '0' then
+		redis.call('HDEL', KEYS[3], ARGV[1])
+	end
+end
+if ARGV[2] ~= '0' then
+	redis.call('RPUSH', list, ARGV[1])
+end
+return left
+`)
+
+	// KEYS: as priorityReserveScript; ARGV: now
+	priorityRequeueScript = redis.NewScript(`
+local total = 0
+for _, msg in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])) do
+	local n = tonumber(redis.call('HGET', KEYS[1], msg) or '0')
+	local list = KEYS[5 + tonumber(redis.call('HGET', KEYS[4], msg) or '0')]
+	for i = 1, n do
+		redis.call('RPUSH', list, msg)
+	end
+	total = total + n
+	redis.call('HDEL', KEYS[1], msg)
+	redis.call('ZREM', KEYS[2], msg)
+	redis.call('HDEL', KEYS[4], msg)
+end
+return total
+`)
+)
+
+// redisPriorityQueue keeps one redis list per priority level, from core.MinPriority to core.MaxPriority.
+// A batch is shared among the levels by weighted round robin, a level weighs its priority plus one,
+// so high priority messages go first while the low ones are not starved. The in-flight messages of all
+// the levels are kept together, each with the level it goes back to.
+type redisPriorityQueue struct {
+	name       string
+	qName      string
+	limit      int
+	visibility time.Duration
+	priority   core.PriorityFunc
+	client     *redis4g.WrapClient
+	levels     []*redisQueue // index 0 is core.MinPriority
+}
+
+// NewRedisPriorityQueue create a priority queue for scheduler2FetcherQ, tasks with a larger
+// Schedule.Priority are popped first, the optional limit bounds its total size
+func NewRedisPriorityQueue(name string, confPath string, limit ...int) core.IQueue {
+	client := redis4g.Connect(confPath)
+	if client == nil {
+		panic(fmt.Sprintf("connect queue %v fail", confPath))
+	}
+
+	pq := &redisPriorityQueue{
+		name:       name,
+		qName:      "sys:" + name,
+		visibility: defaultVisibility,
+		priority:   core.TaskPriority,
+		client:     client,
+	}
+	if len(limit) > 0 && limit[0] > 0 {
+		pq.limit = limit[0]
+	}
+	for p := core.MinPriority; p <= core.MaxPriority; p++ {
+		pq.levels = append(pq.levels, &redisQueue{
+			name:   name,
+			qName:  fmt.Sprintf("%s:p%d", pq.qName, p),
+			client: client,
+		})
+	}
+	return pq
+}
+
+// level returns the index of the list for message, priorities out of range are clamped
+func (pq *redisPriorityQueue) level(message string) int {
+	p := pq.priority(message)
+	if p < core.MinPriority {
+		p = core.MinPriority
+	} else if p > core.MaxPriority {
+		p = core.MaxPriority
+	}
+	return p - core.MinPriority
+}
+
+// signalKey is where Put leaves a token for the consumers blocked in BReserve
+func (pq *redisPriorityQueue) signalKey() string {
+	return pq.client.TransformKey(pq.qName + ":signal")
+}
+
+// listKeys returns the keys of the level lists, the lowest first
+func (pq *redisPriorityQueue) listKeys() []string {
+	names := make([]string, 0, len(pq.levels))
+	for _, lv := range pq.levels {
+		names = append(names, lv.qName)
+	}
+	return pq.client.TransformKeyList(names...)
+}
+
+// keys used by the reliable delivery scripts: inflight counter hash, lease zset, attempts hash, level hash,
+// then the level lists
+func (pq *redisPriorityQueue) reliableKeys() []string {
+	keys := pq.client.TransformKeyList(pq.qName+":inflight", pq.qName+":lease", pq.qName+":attempts", pq.qName+":level")
+	return append(keys, pq.listKeys()...)
+}
+
+func (pq *redisPriorityQueue) Name() string {
+	return pq.name
+}
+
+// Put push every message to the list of its level, the limit is checked on the total size in the same script
+func (pq *redisPriorityQueue) Put(message ...string) error {
+	if len(message) < 1 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, 1+2*len(message))
+	args = append(args, pq.limit)
+	for _, msg := range message {
+		args = append(args, pq.level(msg), msg)
+	}
+	keys := append([]string{pq.signalKey()}, pq.listKeys()...)
+	cnt, err := priorityPutScript.Run(pq.client.Conn(), keys, args...).Int64()
+	if err != nil {
+		return err
+	}
+	if cnt < 0 {
+		return core.ErrQueueFull
+	}
+	return nil
+}
+
+// take collect up to count messages from the levels with fetch, by weighted round robin
+func (pq *redisPriorityQueue) take(count int, fetch func(level int, n int) []string) []string {
+	var totalWeight = 0
+	for i := range pq.levels {
+		totalWeight += i + 1
+	}
+
+	msgArr := make([]string, 0, count)
+
+	// every level gets its weighted share of the batch, the highest first
+	for i := len(pq.levels) - 1; i >= 0 && len(msgArr) < count; i-- {
+		share := count * (i + 1) / totalWeight
+		if share < 1 {
+			share = 1
+		}
+		if left := count - len(msgArr); share > left {
+			share = left
+		}
+		msgArr = append(msgArr, fetch(i, share)...)
+	}
+
+	// shares of the empty levels go to the others, still the highest first
+	for i := len(pq.levels) - 1; i >= 0 && len(msgArr) < count; i-- {
+		msgArr = append(msgArr, fetch(i, count-len(msgArr))...)
+	}
+	return msgArr
+}
+
+func (pq *redisPriorityQueue) Pop(count ...int) []string {
+	cnt := 1
+	if len(count) > 0 && count[0] > 0 {
+		cnt = count[0]
+	}
+	return pq.take(cnt, func(level int, n int) []string {
+		return pq.levels[level].Pop(n)
+	})
+}
+
+func (pq *redisPriorityQueue) Reserve(count ...int) []string {
+	cnt := 1
+	if len(count) > 0 && count[0] > 0 {
+		cnt = count[0]
+	}
+	return pq.take(cnt, func(level int, n int) []string {
+		return pq.reserve(level, n)
+	})
+}
+
+// reserve lease cnt messages of level, they leave their list in the same script
+func (pq *redisPriorityQueue) reserve(level int, cnt int) []string {
+	deadline := time.Now().Add(pq.visibility).UnixNano() / int64(time.Millisecond)
+	ret, err := priorityReserveScript.Run(pq.client.Conn(), pq.reliableKeys(), level, cnt, deadline).Result()
+	if err != nil {
+		logger.WithError(err).WithField("queue", pq.name).Error("reserve fail")
+		return nil
+	}
+
+	items, _ := ret.([]interface{})
+	msgArr := make([]string, 0, len(items))
+	for _, it := range items {
+		if msg, ok := it.(string); ok {
+			msgArr = append(msgArr, msg)
+		}
+	}
+	return msgArr
+}
+
+func (pq *redisPriorityQueue) BPop(timeout time.Duration, count ...int) []string {
+	if msgArr := pq.Pop(count...); len(msgArr) > 0 {
+		return msgArr
+	}
+	_, msg, ok := pq.bPopOne(timeout)
+	if !ok {
+		return []string{}
+	}
+	return []string{msg}
+}
+
+// BReserve wait for a token of Put when every level is empty, then reserve, a message never leaves
+// the levels but in the reserve script, BRPOP on the levels would lose the one it pops if the lease failed
+func (pq *redisPriorityQueue) BReserve(timeout time.Duration, count ...int) []string {
+	if msgArr := pq.Reserve(count...); len(msgArr) > 0 {
+		return msgArr
+	}
+	if timeout < time.Second { // as in bPopOne
+		timeout = time.Second
+	}
+	if err := pq.client.Conn().BRPop(timeout, pq.signalKey()).Err(); err != nil {
+		if err != redis.Nil {
+			logger.WithError(err).WithField("queue", pq.name).Error("blocking reserve fail")
+		}
+		return nil
+	}
+	return pq.Reserve(count...)
+}
+
+// bPopOne wait on all levels, BRPOP checks the keys in order so the highest priority wins
+func (pq *redisPriorityQueue) bPopOne(timeout time.Duration) (int, string, bool) {
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+
+	listKeys := pq.listKeys()
+	keys := make([]string, 0, len(listKeys))
+	byKey := make(map[string]int, len(listKeys))
+	for i := len(listKeys) - 1; i >= 0; i-- {
+		keys = append(keys, listKeys[i])
+		byKey[listKeys[i]] = i
+	}
+
+	ret, err := pq.client.Conn().BRPop(timeout, keys...).Result()
+	if err != nil || len(ret) < 2 {
+		if err != nil && err != redis.Nil {
+			logger.WithError(err).WithField("queue", pq.name).Error("blocking pop fail")
+		}
+		return 0, "", false
+	}
+	return byKey[ret[0]], ret[1], true
+}
+
+func (pq *redisPriorityQueue) Size() int {
+	var size = 0
+	for _, lv := range pq.levels {
+		size += lv.Size()
+	}
+	return size
+}
+
+func (pq *redisPriorityQueue) Limit() int {
+	return pq.limit
+}
+
+func (pq *redisPriorityQueue) Ack(message string) error {
+	return pq.release(message, releaseAck)
+}
+
+func (pq *redisPriorityQueue) Nack(message string) error {
+	return pq.release(message, releaseNack)
+}
+
+// Release give message back as Nack does, but its delivery is not counted as an attempt
+func (pq *redisPriorityQueue) Release(message string) error {
+	return pq.release(message, releaseUntouched)
+}
+
+// release end a lease of message, a requeued one goes back to the level it was reserved from
+func (pq *redisPriorityQueue) release(message string, mode string) error {
+	left, err := priorityReleaseScript.Run(pq.client.Conn(), pq.reliableKeys(), message, mode).Int64()
+	if err != nil {
+		return err
+	}
+	if left < 0 {
+		return errors.New("message is not in flight")
+	}
+	return nil
+}
+
+func (pq *redisPriorityQueue) Requeue() int {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	cnt, err := priorityRequeueScript.Run(pq.client.Conn(), pq.reliableKeys(), now).Int64()
+	if err != nil {
+		logger.WithError(err).WithField("queue", pq.name).Error("requeue fail")
+		return 0
+	}
+	return int(cnt)
+}
+
+func (pq *redisPriorityQueue) Attempts(message string) int {
+	cnt, _ := pq.client.Conn().HGet(pq.client.TransformKey(pq.qName+":attempts"), message).Int()
+	return cnt
+}
+
+func (pq *redisPriorityQueue) SetVisibility(timeout time.Duration) {
+	if timeout > 0 {
+		pq.visibility = timeout
+	}
+}
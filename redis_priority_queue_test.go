@@ -0,0 +1,95 @@
+package spider
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+// testRedisPriorityQueue create an empty priority queue, leases and all
+func testRedisPriorityQueue(t *testing.T) *redisPriorityQueue {
+	pq := NewRedisPriorityQueue("test:"+t.Name(), redisConf(t)).(*redisPriorityQueue)
+	_ = pq.client.Conn().Del(append(pq.reliableKeys(), pq.signalKey())...).Err()
+	return pq
+}
+
+func priorityMessage(url string, priority int) string {
+	task := core.NewTask(url)
+	task.Schedule.Priority = priority
+	bytes, _ := json.Marshal(core.Schedule2FetchMessage{Task: task})
+	return string(bytes)
+}
+
+func TestRedisPriorityQueueLevels(t *testing.T) {
+	pq := testRedisPriorityQueue(t)
+	pq.SetVisibility(50 * time.Millisecond)
+	list1, list2 := priorityMessage("list1", core.DefaultPriority), priorityMessage("list2", core.DefaultPriority)
+	detail, login := priorityMessage("detail", 7), priorityMessage("login", 9)
+	_ = pq.Put(list1, list2, detail, login)
+
+	if msgs := pq.Reserve(2); len(msgs) != 2 || msgs[0] != login || msgs[1] != detail {
+		t.Fatalf("higher priority should go first, got %v", msgs)
+	}
+	if err := pq.Nack(detail); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := pq.Reserve(3); len(msgs) != 3 || msgs[0] != detail || msgs[1] != list1 || msgs[2] != list2 {
+		t.Fatalf("a nacked message should go back to its level, got %v", msgs)
+	}
+	if pq.Attempts(detail) != 2 || pq.Ack(login) != nil || pq.Ack(login) == nil {
+		t.Fatalf("the leases of all the levels should be kept together")
+	}
+	if err := pq.Release(detail); err != nil || pq.Attempts(detail) != 1 {
+		t.Fatalf("a released delivery should not count, got %v", err)
+	}
+	if msgs := pq.Reserve(); len(msgs) != 1 || msgs[0] != detail {
+		t.Fatalf("a released message should go back to its level, got %v", msgs)
+	}
+
+	_ = pq.Put(login)
+	_ = pq.Reserve()
+	time.Sleep(100 * time.Millisecond)
+	if cnt := pq.Requeue(); cnt != 4 {
+		t.Fatalf("every expired lease should be given back, requeued %d", cnt)
+	}
+	if msgs := pq.Pop(4); len(msgs) != 4 || msgs[0] != login || msgs[1] != detail {
+		t.Fatalf("the requeued messages should go back to their levels, got %v", msgs)
+	}
+}
+
+func TestRedisPriorityQueueLimit(t *testing.T) {
+	pq := testRedisPriorityQueue(t)
+	pq.limit = 3
+	if err := pq.Put(priorityMessage("a", 1), priorityMessage("b", 9)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pq.Put(priorityMessage("c", 5), priorityMessage("d", 5)); err != core.ErrQueueFull || pq.Size() != 2 {
+		t.Fatalf("the limit is on the size of all the levels, got %v, size %d", err, pq.Size())
+	}
+}
+
+func TestRedisPriorityQueueBReserve(t *testing.T) {
+	pq := testRedisPriorityQueue(t)
+
+	time.AfterFunc(100*time.Millisecond, func() { _ = pq.Put(`{"task":{"url":"http://a.com/"}}`) })
+	start := time.Now()
+	if msgs := pq.BReserve(3 * time.Second); len(msgs) != 1 || pq.Attempts(msgs[0]) != 1 {
+		t.Fatalf("should lease the message put while waiting, got %v", msgs)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("put should wake the waiting consumer, waited %v", time.Since(start))
+	}
+
+	// the token of a message reserved without waiting is stale, it only ends a wait early
+	_ = pq.Put(`{"task":{"url":"http://b.com/"}}`)
+	if msgs := pq.Reserve(); len(msgs) != 1 {
+		t.Fatalf("should reserve the message, got %v", msgs)
+	}
+	if msgs := pq.BReserve(time.Second); len(msgs) != 0 {
+		t.Fatalf("nothing is left to reserve, got %v", msgs)
+	}
+}
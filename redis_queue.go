@@ -3,28 +3,141 @@ package spider
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 import (
+	"github.com/go-redis/redis"
 	"github.com/xgo11/redis4g"
+	"github.com/xgo11/spider/common"
 	"github.com/xgo11/spider/core"
 )
 
+const (
+	defaultVisibility = 5 * time.Minute
+	putChunkSize      = 1000 // messages per LPUSH, keeps a huge batch from building one giant command
+
+	// modes of the release scripts
+	releaseAck       = "0"
+	releaseNack      = "1" // requeued, the delivery counts as an attempt
+	releaseUntouched = "2" // requeued, the delivery does not count
+)
+
 var (
-	_ core.IQueue = &redisQueue{}
+	_ core.IQueue          = &redisQueue{}
+	_ core.IReliableQueue  = &redisQueue{}
+	_ core.IBrowsableQueue = &redisQueue{}
+
+	_ core.IBlockingQueue         = &redisQueue{}
+	_ core.IBlockingReliableQueue = &redisQueue{}
+	_ core.IReleasableQueue       = &redisQueue{}
+
+	logger = common.GetLogger("spider")
+)
+
+var (
+	// KEYS: queue; ARGV: limit, chunk size, messages...
+	boundedPutScript = redis.NewScript(`
+if redis.call('LLEN', KEYS[1]) + #ARGV - 2 > tonumber(ARGV[1]) then
+	return -1
+end
+local size = tonumber(ARGV[2])
+local cnt = 0
+for i = 3, #ARGV, size do
+	cnt = redis.call('LPUSH', KEYS[1], unpack(ARGV, i, math.min(i + size - 1, #ARGV)))
+end
+return cnt
+`)
+
+	// KEYS: queue, inflight counter hash, lease zset, attempts hash, claim list; ARGV: count, deadline, claimed message,
+	// the claimed message is leased only if it is still in the claim list, Requeue may have given it back already
+	reserveScript = redis.NewScript(`
+local out = {}
+local function lease(msg)
+	redis.call('HINCRBY', KEYS[2], msg, 1)
+	redis.call('HINCRBY', KEYS[4], msg, 1)
+	redis.call('ZADD', KEYS[3], ARGV[2], msg)
+	out[#out + 1] = msg
+end
+if ARGV[3] and redis.call('LREM', KEYS[5], 1, ARGV[3]) > 0 then
+	lease(ARGV[3])
+end
+for i = 1, tonumber(ARGV[1]) do
+	local msg = redis.call('RPOP', KEYS[1])
+	if not msg then
+		break
+	end
+	lease(msg)
+end
+return out
+`)
+
+	// KEYS: as reserveScript; ARGV: message, release mode
+	releaseScript = redis.NewScript(`
+local left = redis.call('HINCRBY', KEYS[2], ARGV[1], -1)
+if left < 0 then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	return -1
+end
+if ARGV[2] == '2' then
+	redis.call('HINCRBY', KEYS[4], ARGV[1], -1)
+end
+if left == 0 then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	redis.call('ZREM', KEYS[3], ARGV[1])
+	if ARGV[2] == '0' then
+		redis.call('HDEL', KEYS[4], ARGV[1])
+	end
+end
+if ARGV[2] ~= '0' then
+	redis.call('RPUSH', KEYS[1], ARGV[1])
+end
+return left
+`)
+
+	// KEYS: as reserveScript; ARGV: now, the claim list is given back as a whole,
+	// a message is left there only when its consumer lost the connection before leasing it
+	requeueScript = redis.NewScript(`
+local total = 0
+while true do
+	local msg = redis.call('RPOP', KEYS[5])
+	if not msg then
+		break
+	end
+	redis.call('RPUSH', KEYS[1], msg)
+	total = total + 1
+end
+for _, msg in ipairs(redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])) do
+	local n = tonumber(redis.call('HGET', KEYS[2], msg) or '0')
+	for i = 1, n do
+		redis.call('RPUSH', KEYS[1], msg)
+	end
+	total = total + n
+	redis.call('HDEL', KEYS[2], msg)
+	redis.call('ZREM', KEYS[3], msg)
+end
+return total
+`)
 )
 
 type redisQueue struct {
-	name   string
-	qName  string
-	client *redis4g.WrapClient
+	name       string
+	qName      string
+	limit      int
+	visibility time.Duration
+	client     *redis4g.WrapClient
 }
 
-func NewRedisQueue(name string, confPath string) core.IQueue {
+// NewRedisQueue create a queue on the redis of confPath, the optional limit bounds its size
+func NewRedisQueue(name string, confPath string, limit ...int) core.IQueue {
 	client := redis4g.Connect(confPath)
 	if client == nil {
 		panic(fmt.Sprintf("connect queue %v fail", confPath))
 	}
-	return &redisQueue{name: name, qName: "sys:" + name, client: client}
+	rq := &redisQueue{name: name, qName: "sys:" + name, visibility: defaultVisibility, client: client}
+	if len(limit) > 0 && limit[0] > 0 {
+		rq.limit = limit[0]
+	}
+	return rq
 }
 
 func (rq *redisQueue) Name() string {
@@ -32,35 +145,82 @@ func (rq *redisQueue) Name() string {
 }
 
 func (rq *redisQueue) Put(message ...string) error {
+	if len(message) < 1 {
+		return nil
+	}
 
 	var its = make([]interface{}, len(message))
 	for i, msg := range message {
 		its[i] = msg
 	}
 
-	if cnt := rq.client.LPush(rq.qName, its...); cnt > 0 {
+	if rq.limit > 0 {
+		args := append([]interface{}{rq.limit, putChunkSize}, its...)
+		cnt, err := boundedPutScript.Run(rq.client.Conn(), rq.client.TransformKeyList(rq.qName), args...).Int64()
+		if err != nil {
+			return err
+		}
+		if cnt < 0 {
+			return core.ErrQueueFull
+		}
 		return nil
 	}
 
-	return errors.New("put message fail")
+	if len(its) <= putChunkSize {
+		if cnt := rq.client.LPush(rq.qName, its...); cnt > 0 {
+			return nil
+		}
+		return errors.New("put message fail")
+	}
+
+	// a very large batch is split into chunks, pushed in one transaction
+	key := rq.client.TransformKey(rq.qName)
+	_, err := rq.client.Conn().TxPipelined(func(pipe redis.Pipeliner) error {
+		for start := 0; start < len(its); start += putChunkSize {
+			end := start + putChunkSize
+			if end > len(its) {
+				end = len(its)
+			}
+			pipe.LPush(key, its[start:end]...)
+		}
+		return nil
+	})
+	return err
 }
 
+// Pop remove and return up to count oldest messages, a batch is taken in one atomic round-trip
 func (rq *redisQueue) Pop(count ...int) []string {
 	cnt := 1
 	if len(count) > 0 && count[0] > 0 {
 		cnt = count[0]
 	}
 
-	msgArr := make([]string, 0, cnt)
-	for ; cnt > 0; cnt-- {
+	if cnt == 1 {
 		if msg := rq.client.RPop(rq.qName); msg != "" {
-			msgArr = append(msgArr, msg)
-			continue
+			return []string{msg}
 		}
-		break
+		return []string{}
 	}
-	return msgArr
 
+	// the oldest messages are on the right end, take them and trim them off in a transaction
+	key := rq.client.TransformKey(rq.qName)
+	var rangeCmd *redis.StringSliceCmd
+	_, err := rq.client.Conn().TxPipelined(func(pipe redis.Pipeliner) error {
+		rangeCmd = pipe.LRange(key, -int64(cnt), -1)
+		pipe.LTrim(key, 0, -int64(cnt)-1)
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).WithField("queue", rq.name).Error("pop fail")
+		return []string{}
+	}
+
+	items := rangeCmd.Val()
+	msgArr := make([]string, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		msgArr = append(msgArr, items[i])
+	}
+	return msgArr
 }
 
 func (rq *redisQueue) Size() int {
@@ -68,5 +228,165 @@ func (rq *redisQueue) Size() int {
 }
 
 func (rq *redisQueue) Limit() int {
-	return 0
+	return rq.limit
+}
+
+// keys used by the reliable delivery scripts: queue, inflight counter hash, lease zset, attempts hash, claim list
+func (rq *redisQueue) reliableKeys() []string {
+	return rq.client.TransformKeyList(rq.qName, rq.qName+":inflight", rq.qName+":lease", rq.qName+":attempts",
+		rq.qName+":claim")
+}
+
+func (rq *redisQueue) Reserve(count ...int) []string {
+	cnt := 1
+	if len(count) > 0 && count[0] > 0 {
+		cnt = count[0]
+	}
+	return rq.reserve(cnt)
+}
+
+// reserve lease cnt messages, and the claimed one if it was already moved to the claim list,
+// where it stays for Requeue when the lease fails
+func (rq *redisQueue) reserve(cnt int, claimed ...interface{}) []string {
+	deadline := time.Now().Add(rq.visibility).UnixNano() / int64(time.Millisecond)
+	args := append([]interface{}{cnt, deadline}, claimed...)
+	ret, err := reserveScript.Run(rq.client.Conn(), rq.reliableKeys(), args...).Result()
+	if err != nil {
+		logger.WithError(err).WithField("queue", rq.name).Error("reserve fail")
+		return nil
+	}
+
+	items, _ := ret.([]interface{})
+	msgArr := make([]string, 0, len(items))
+	for _, it := range items {
+		if msg, ok := it.(string); ok {
+			msgArr = append(msgArr, msg)
+		}
+	}
+	return msgArr
+}
+
+// BReserve wait for the first message with BRPOPLPUSH, which moves it to the claim list in the same step,
+// then lease it together with the rest of the batch
+func (rq *redisQueue) BReserve(timeout time.Duration, count ...int) []string {
+	cnt := 1
+	if len(count) > 0 && count[0] > 0 {
+		cnt = count[0]
+	}
+
+	if timeout < time.Second { // as in bPopOne
+		timeout = time.Second
+	}
+	source, claim := rq.client.TransformKey(rq.qName), rq.client.TransformKey(rq.qName+":claim")
+	msg, err := rq.client.Conn().BRPopLPush(source, claim, timeout).Result()
+	if err != nil {
+		if err != redis.Nil {
+			logger.WithError(err).WithField("queue", rq.name).Error("blocking reserve fail")
+		}
+		return nil
+	}
+	return rq.reserve(cnt-1, msg)
+}
+
+func (rq *redisQueue) BPop(timeout time.Duration, count ...int) []string {
+	cnt := 1
+	if len(count) > 0 && count[0] > 0 {
+		cnt = count[0]
+	}
+
+	msg, ok := rq.bPopOne(timeout)
+	if !ok {
+		return []string{}
+	}
+	msgArr := []string{msg}
+	if cnt > 1 {
+		msgArr = append(msgArr, rq.Pop(cnt-1)...)
+	}
+	return msgArr
+}
+
+func (rq *redisQueue) bPopOne(timeout time.Duration) (string, bool) {
+	// BRPOP takes whole seconds, and 0 would block forever
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	ret, err := rq.client.Conn().BRPop(timeout, rq.client.TransformKey(rq.qName)).Result()
+	if err != nil || len(ret) < 2 {
+		if err != nil && err != redis.Nil {
+			logger.WithError(err).WithField("queue", rq.name).Error("blocking pop fail")
+		}
+		return "", false
+	}
+	return ret[1], true
+}
+
+func (rq *redisQueue) Ack(message string) error {
+	return rq.release(message, releaseAck)
+}
+
+func (rq *redisQueue) Nack(message string) error {
+	return rq.release(message, releaseNack)
+}
+
+// Release give message back as Nack does, but its delivery is not counted as an attempt
+func (rq *redisQueue) Release(message string) error {
+	return rq.release(message, releaseUntouched)
+}
+
+func (rq *redisQueue) release(message string, mode string) error {
+	left, err := releaseScript.Run(rq.client.Conn(), rq.reliableKeys(), message, mode).Int64()
+	if err != nil {
+		return err
+	}
+	if left < 0 {
+		return errors.New("message is not in flight")
+	}
+	return nil
+}
+
+func (rq *redisQueue) Requeue() int {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	cnt, err := requeueScript.Run(rq.client.Conn(), rq.reliableKeys(), now).Int64()
+	if err != nil {
+		logger.WithError(err).WithField("queue", rq.name).Error("requeue fail")
+		return 0
+	}
+	return int(cnt)
+}
+
+func (rq *redisQueue) Attempts(message string) int {
+	cnt, _ := rq.client.Conn().HGet(rq.client.TransformKey(rq.qName+":attempts"), message).Int()
+	return cnt
+}
+
+func (rq *redisQueue) SetVisibility(timeout time.Duration) {
+	if timeout > 0 {
+		rq.visibility = timeout
+	}
+}
+
+// Range list messages in pop order without removing them
+func (rq *redisQueue) Range(offset, limit int) []string {
+	if offset < 0 || limit <= 0 {
+		return nil
+	}
+	// messages are pushed on the left and popped on the right
+	start, stop := -int64(offset+limit), -int64(offset+1)
+	items := rq.client.LRange(rq.qName, start, stop)
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items
+}
+
+// Remove delete the first queued copy of message
+func (rq *redisQueue) Remove(message string) error {
+	cnt, err := rq.client.Conn().LRem(rq.client.TransformKey(rq.qName), -1, message).Result()
+	if err != nil {
+		return err
+	}
+	if cnt < 1 {
+		return errors.New("message not found")
+	}
+	return nil
 }
@@ -0,0 +1,161 @@
+package spider
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/redis4g"
+)
+
+// tests and benchmarks on redis need one, set SPIDER_REDIS_CONF to a redis4g config path, e.g. "local/test"
+func redisConf(tb testing.TB) string {
+	path := os.Getenv("SPIDER_REDIS_CONF")
+	if path == "" {
+		tb.Skip("SPIDER_REDIS_CONF not set")
+	}
+	if redis4g.Connect(path) == nil {
+		tb.Skipf("connect redis %v fail", path)
+	}
+	return path
+}
+
+func benchRedisQueue(b *testing.B) *redisQueue {
+	rq := NewRedisQueue("bench:"+b.Name(), redisConf(b)).(*redisQueue)
+	rq.client.Delete(rq.qName)
+	return rq
+}
+
+// testRedisQueue create an empty queue, leases and all
+func testRedisQueue(t *testing.T) *redisQueue {
+	rq := NewRedisQueue("test:"+t.Name(), redisConf(t)).(*redisQueue)
+	_ = rq.client.Conn().Del(rq.reliableKeys()...).Err()
+	return rq
+}
+
+func fillRedisQueue(b *testing.B, rq *redisQueue, count int) {
+	messages := make([]string, count)
+	for i := range messages {
+		messages[i] = fmt.Sprintf(`{"task":{"url":"http://example.com/%d"}}`, i)
+	}
+	if err := rq.Put(messages...); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// popEach is how Pop worked before, one RPOP round-trip per message
+func popEach(rq *redisQueue, count int) []string {
+	msgArr := make([]string, 0, count)
+	for ; count > 0; count-- {
+		if msg := rq.client.RPop(rq.qName); msg != "" {
+			msgArr = append(msgArr, msg)
+			continue
+		}
+		break
+	}
+	return msgArr
+}
+
+func BenchmarkRedisQueuePopEach(b *testing.B) {
+	rq := benchRedisQueue(b)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fillRedisQueue(b, rq, 1000)
+		b.StartTimer()
+		if msgs := popEach(rq, 1000); len(msgs) != 1000 {
+			b.Fatalf("pop %d", len(msgs))
+		}
+	}
+}
+
+func BenchmarkRedisQueuePopBatch(b *testing.B) {
+	rq := benchRedisQueue(b)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fillRedisQueue(b, rq, 1000)
+		b.StartTimer()
+		if msgs := rq.Pop(1000); len(msgs) != 1000 {
+			b.Fatalf("pop %d", len(msgs))
+		}
+	}
+}
+
+func BenchmarkRedisQueuePutChunked(b *testing.B) {
+	rq := benchRedisQueue(b)
+	for i := 0; i < b.N; i++ {
+		fillRedisQueue(b, rq, 10000)
+		b.StopTimer()
+		rq.client.Delete(rq.qName)
+		b.StartTimer()
+	}
+}
+
+func TestRedisQueueBReserveClaims(t *testing.T) {
+	rq := testRedisQueue(t)
+	claim := rq.client.TransformKey(rq.qName + ":claim")
+	_ = rq.Put("a", "b", "c")
+
+	if msgs := rq.BReserve(time.Second, 2); len(msgs) != 2 || msgs[0] != "a" || msgs[1] != "b" {
+		t.Fatalf("should lease the claimed message and the next ones, got %v", msgs)
+	}
+	if n := rq.client.Conn().LLen(claim).Val(); n != 0 {
+		t.Fatalf("a leased message should leave the claim list, %d left", n)
+	}
+
+	// a consumer lost between the claim and the lease
+	msg := rq.client.Conn().BRPopLPush(rq.client.TransformKey(rq.qName), claim, time.Second).Val()
+	if cnt := rq.Requeue(); cnt != 1 || rq.Size() != 1 {
+		t.Fatalf("requeue should give back the claimed message, requeued %d, size %d", cnt, rq.Size())
+	}
+	if msgs := rq.reserve(0, msg); len(msgs) != 0 {
+		t.Fatalf("a message given back should not be leased by its late claimer, got %v", msgs)
+	}
+	if msgs := rq.BReserve(time.Second); len(msgs) != 1 || msgs[0] != "c" || rq.Attempts("c") != 1 {
+		t.Fatalf("the message given back should be delivered again, got %v", msgs)
+	}
+}
+
+func TestRedisQueueReliable(t *testing.T) {
+	rq := testRedisQueue(t)
+	_ = rq.Put("a", "b")
+
+	if msgs := rq.Reserve(); len(msgs) != 1 || msgs[0] != "a" || rq.Attempts("a") != 1 || rq.Size() != 1 {
+		t.Fatalf("should lease the oldest message, got %v", msgs)
+	}
+	if err := rq.Nack("a"); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := rq.Reserve(); len(msgs) != 1 || msgs[0] != "a" || rq.Attempts("a") != 2 {
+		t.Fatalf("a nacked message should be next, attempts counted, got %v", msgs)
+	}
+	if err := rq.Release("a"); err != nil || rq.Attempts("a") != 1 || rq.Size() != 2 {
+		t.Fatalf("a released message should go back, its delivery not counted, got %v", err)
+	}
+	if msgs := rq.Reserve(); len(msgs) != 1 || msgs[0] != "a" || rq.Attempts("a") != 2 {
+		t.Fatalf("a released message should be next, got %v", msgs)
+	}
+	if err := rq.Ack("a"); err != nil || rq.Attempts("a") != 0 {
+		t.Fatalf("ack should end the lease and forget the attempts, got %v", err)
+	}
+	if err := rq.Ack("a"); err == nil {
+		t.Fatalf("a message not in flight can not be acked")
+	}
+
+	rq.SetVisibility(50 * time.Millisecond)
+	if msgs := rq.Reserve(); len(msgs) != 1 || msgs[0] != "b" {
+		t.Fatalf("should lease the next message, got %v", msgs)
+	}
+	if cnt := rq.Requeue(); cnt != 0 {
+		t.Fatalf("a lease not expired should be kept, requeued %d", cnt)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if cnt := rq.Requeue(); cnt != 1 || rq.Size() != 1 || rq.Attempts("b") != 1 {
+		t.Fatalf("an expired lease should be given back, requeued %d, size %d", cnt, rq.Size())
+	}
+	if err := rq.Ack("b"); err == nil {
+		t.Fatalf("a requeued message is not in flight anymore")
+	}
+}
@@ -0,0 +1,82 @@
+package spider
+
+import (
+	"fmt"
+	"time"
+)
+import (
+	"github.com/go-redis/redis"
+	"github.com/xgo11/redis4g"
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.IRateLimiter = &redisRateLimiter{}
+)
+
+var (
+	// KEYS: bucket hashes; ARGV: now in ms, then qps and capacity of every bucket;
+	// takes a token of every bucket, they may go below zero, and returns ms to wait for the last one
+	reserveTokenScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tokens, lasts, wait = {}, {}, 0
+for i, key in ipairs(KEYS) do
+	local qps, capacity = tonumber(ARGV[2 * i]), tonumber(ARGV[2 * i + 1])
+	local bucket = redis.call('HMGET', key, 'tokens', 'last')
+	tokens[i] = tonumber(bucket[1]) or capacity
+	local last = tonumber(bucket[2]) or now
+	if now > last then
+		tokens[i] = math.min(capacity, tokens[i] + (now - last) * qps / 1000)
+		last = now
+	end
+	lasts[i] = last
+	if tokens[i] < 1 then
+		wait = math.max(wait, math.ceil((1 - tokens[i]) * 1000 / qps))
+	end
+end
+for i, key in ipairs(KEYS) do
+	local qps, capacity = tonumber(ARGV[2 * i]), tonumber(ARGV[2 * i + 1])
+	redis.call('HMSET', key, 'tokens', tostring(tokens[i] - 1), 'last', lasts[i])
+	redis.call('PEXPIRE', key, math.ceil((capacity - tokens[i] + 1) * 1000 / qps) + 1000)
+end
+return wait
+`)
+)
+
+// redisRateLimiter keeps the buckets in redis, so the schedulers sharing it share the limits
+type redisRateLimiter struct {
+	name   string
+	client *redis4g.WrapClient
+}
+
+func NewRedisRateLimiter(name string, confPath string) core.IRateLimiter {
+	client := redis4g.Connect(confPath)
+	if client == nil {
+		panic(fmt.Sprintf("connect rate limiter %v fail", confPath))
+	}
+	return &redisRateLimiter{name: name, client: client}
+}
+
+func (rl *redisRateLimiter) Reserve(keys []string, limits []core.RateLimit) (time.Duration, error) {
+	var bucketKeys []string
+	args := []interface{}{
+		// the clocks of the schedulers are trusted, a bucket never goes back in time
+		time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	for i, key := range keys {
+		if limits[i].Unlimited() {
+			continue
+		}
+		bucketKeys = append(bucketKeys, fmt.Sprintf("sys:ratelimit:%s:%s", rl.name, key))
+		args = append(args, limits[i].QPS, limits[i].Capacity())
+	}
+	if len(bucketKeys) == 0 {
+		return 0, nil
+	}
+
+	wait, err := reserveTokenScript.Run(rl.client.Conn(), rl.client.TransformKeyList(bucketKeys...), args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,44 @@
+package spider
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestRedisRateLimiter(t *testing.T) {
+	rl := NewRedisRateLimiter("test:"+t.Name(), redisConf(t)).(*redisRateLimiter)
+	host, project := core.RateLimit{QPS: 10, Burst: 2}, core.RateLimit{QPS: 10, Burst: 1}
+	for _, key := range []string{"host:a", "host:b", "project:p"} {
+		rl.client.Delete("sys:ratelimit:" + rl.name + ":" + key)
+	}
+
+	hostA := []string{"host:a"}
+	for i := 0; i < 2; i++ {
+		if wait, err := rl.Reserve(hostA, []core.RateLimit{host}); err != nil || wait != 0 {
+			t.Fatalf("burst token %d should be taken, wait %v %v", i, wait, err)
+		}
+	}
+	wait, _ := rl.Reserve(hostA, []core.RateLimit{host})
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("empty bucket should wait for the next token, wait %v", wait)
+	}
+	if next, _ := rl.Reserve(hostA, []core.RateLimit{host}); next <= wait || next > 200*time.Millisecond {
+		t.Fatalf("reservations should be staggered, wait %v after %v", next, wait)
+	}
+	if w, _ := rl.Reserve(hostA, []core.RateLimit{{}}); w != 0 {
+		t.Fatalf("an unlimited key should not wait, wait %v", w)
+	}
+
+	// one bucket empty holds the task, and every bucket gives a token
+	_, _ = rl.Reserve([]string{"project:p"}, []core.RateLimit{project})
+	if w, _ := rl.Reserve([]string{"host:b", "project:p"}, []core.RateLimit{host, project}); w <= 0 {
+		t.Fatalf("an empty project bucket should hold the task, wait %v", w)
+	}
+	if w, _ := rl.Reserve([]string{"host:b"}, []core.RateLimit{host}); w != 0 {
+		t.Fatalf("the host bucket should keep its second token, wait %v", w)
+	}
+}
@@ -0,0 +1,151 @@
+package spider
+
+import (
+	"encoding/json"
+	"fmt"
+)
+import (
+	"github.com/go-redis/redis"
+	"github.com/xgo11/redis4g"
+	"github.com/xgo11/spider/core"
+)
+
+var (
+	_ core.ITaskStore = &redisTaskStore{}
+)
+
+const maxUpdateTries = 10
+
+var (
+	// KEYS: zset; ARGV: now, until, count
+	claimRecrawlScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[3]))
+for _, member in ipairs(members) do
+	redis.call('ZADD', KEYS[1], ARGV[2], member)
+end
+return members
+`)
+)
+
+// redisTaskStore keeps one hash per project, the field is the task id and the value the encoded task,
+// the auto recrawl tasks are indexed in a sorted set scored by their next crawl time
+type redisTaskStore struct {
+	name   string
+	client *redis4g.WrapClient
+}
+
+func NewRedisTaskStore(name string, confPath string) core.ITaskStore {
+	client := redis4g.Connect(confPath)
+	if client == nil {
+		panic(fmt.Sprintf("connect task store %v fail", confPath))
+	}
+	return &redisTaskStore{name: name, client: client}
+}
+
+func (rs *redisTaskStore) hName(project string) string {
+	return "sys:tasks:" + rs.name + ":" + project
+}
+
+func (rs *redisTaskStore) zName() string {
+	return "sys:tasks:" + rs.name + ":recrawl"
+}
+
+// recrawl index members are encoded [project, task id]
+func recrawlMember(project, taskId string) string {
+	bytes, _ := json.Marshal([]string{project, taskId})
+	return string(bytes)
+}
+
+func (rs *redisTaskStore) Get(project, taskId string) (*core.Task, bool) {
+	if data := rs.client.HGet(rs.hName(project), taskId); data != "" {
+		task := &core.Task{}
+		if err := json.Unmarshal([]byte(data), task); err == nil {
+			return task, true
+		}
+	}
+	return nil, false
+}
+
+func (rs *redisTaskStore) Save(task *core.Task) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.client.Conn().TxPipelined(func(pipe redis.Pipeliner) error {
+		rs.save(pipe, task, data)
+		return nil
+	})
+	return err
+}
+
+// Update watches the project hash and tries again when another writer saved in between
+func (rs *redisTaskStore) Update(project, taskId string, change func(task *core.Task) bool) error {
+	key := rs.client.TransformKey(rs.hName(project))
+
+	var err error
+	for i := 0; i < maxUpdateTries; i++ {
+		err = rs.client.Conn().Watch(func(tx *redis.Tx) error {
+			old, err := tx.HGet(key, taskId).Result()
+			if err == redis.Nil {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			task := &core.Task{}
+			if err := json.Unmarshal([]byte(old), task); err != nil {
+				return err
+			}
+			if !change(task) {
+				return nil
+			}
+			data, err := json.Marshal(task)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				rs.save(pipe, task, data)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+func (rs *redisTaskStore) save(pipe redis.Pipeliner, task *core.Task, data []byte) {
+	zKey := rs.client.TransformKey(rs.zName())
+	member := recrawlMember(task.Project, task.TaskId)
+
+	pipe.HSet(rs.client.TransformKey(rs.hName(task.Project)), task.TaskId, string(data))
+	if next := task.NextCrawl(); next > 0 {
+		pipe.ZAdd(zKey, redis.Z{Score: float64(next), Member: member})
+	} else {
+		pipe.ZRem(zKey, member)
+	}
+}
+
+func (rs *redisTaskStore) DueRecrawl(now int64, lease int64, count int) []*core.Task {
+	ret, err := claimRecrawlScript.Run(rs.client.Conn(), rs.client.TransformKeyList(rs.zName()), now, now+lease, count).Result()
+	if err != nil {
+		logger.WithError(err).WithField("store", rs.name).Error("claim recrawl fail")
+		return nil
+	}
+
+	items, _ := ret.([]interface{})
+	var tasks []*core.Task
+	for _, it := range items {
+		member, _ := it.(string)
+		var key []string
+		if err := json.Unmarshal([]byte(member), &key); err != nil || len(key) != 2 {
+			continue
+		}
+		if task, ok := rs.Get(key[0], key[1]); ok {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
@@ -0,0 +1,79 @@
+package spider
+
+import (
+	"sync"
+	"testing"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+// testRedisTaskStore create a store without the tasks of project
+func testRedisTaskStore(t *testing.T, project string) *redisTaskStore {
+	rs := NewRedisTaskStore("test:"+t.Name(), redisConf(t)).(*redisTaskStore)
+	rs.client.Delete(rs.hName(project), rs.zName())
+	return rs
+}
+
+func TestRedisTaskStoreClaimsRecrawl(t *testing.T) {
+	rs := testRedisTaskStore(t, "news")
+	for _, id := range []string{"a", "b", "once"} {
+		task := core.NewTask("http://localhost/" + id)
+		task.Project, task.TaskId = "news", id
+		task.UpdateTime = 1000
+		task.Schedule.AutoRecrawl = id != "once"
+		task.Schedule.Age = 100
+		if err := rs.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tasks := rs.DueRecrawl(1099, 60, 10); len(tasks) != 0 {
+		t.Fatalf("nothing is due, got %v", tasks)
+	}
+	if tasks := rs.DueRecrawl(1100, 60, 1); len(tasks) != 1 {
+		t.Fatalf("should claim up to count, got %v", tasks)
+	}
+	tasks := rs.DueRecrawl(1100, 60, 10)
+	if len(tasks) != 1 || tasks[0].Project != "news" {
+		t.Fatalf("a claimed task should not be due again, got %v", tasks)
+	}
+	if tasks = rs.DueRecrawl(1159, 60, 10); len(tasks) != 0 {
+		t.Fatalf("the claims should hold for their lease, got %v", tasks)
+	}
+	if tasks = rs.DueRecrawl(1160, 60, 10); len(tasks) != 2 {
+		t.Fatalf("the tasks not saved again should be due after their lease, got %v", tasks)
+	}
+}
+
+func TestRedisTaskStoreUpdate(t *testing.T) {
+	rs := testRedisTaskStore(t, "news")
+	task := core.NewTask("http://localhost/update")
+	task.Project, task.TaskId = "news", "update"
+	_ = rs.Save(task)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rs.Update("news", "update", func(tsk *core.Task) bool {
+				tsk.Schedule.Retried++
+				return true
+			}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if tsk, _ := rs.Get("news", "update"); tsk.Schedule.Retried != 5 {
+		t.Fatalf("every update should be kept, got %d", tsk.Schedule.Retried)
+	}
+	if err := rs.Update("news", "unknown", func(*core.Task) bool { return true }); err != nil {
+		t.Fatalf("an unknown task should be ignored, got %v", err)
+	}
+	if _, ok := rs.Get("news", "unknown"); ok {
+		t.Fatalf("an unknown task should not be created")
+	}
+}
@@ -0,0 +1,109 @@
+package spider
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/datetime"
+	"github.com/xgo11/spider/components/processor"
+	"github.com/xgo11/spider/core"
+)
+
+func TestProcessorRetrySchedule(t *testing.T) {
+	builder := newProject("retry_test")
+	builder.AddCallback(core.ProcessCallback{
+		Name: "index",
+		Callback: func(task *core.Task, resp *core.Response) ([]*core.Task, *core.Result) {
+			return nil, nil
+		},
+	})
+	builder.(core.IRetryScheduled).SetRetrySchedule(core.RetrySchedule{Delays: []int64{60}})
+	builder.RegisterMe()
+
+	newQ := NewMemoryQueue("new", 0)
+	f2pQ := NewMemoryQueue("f2p", 0)
+	deadQ := NewMemoryQueue("dead", 0)
+	p := processor.NewProcessor(newQ, f2pQ, NewMemoryQueue("p2r", 0), nil)
+	core.SetDeadLetterQueue(p, deadQ)
+	defer start(p)()
+
+	failed := func(task *core.Task) {
+		putFetched(t, f2pQ, task, &core.Response{StatusCode: core.StatusFetchError, ErrMessage: "connection refused"})
+	}
+	wait := func(q core.IQueue) string {
+		waitFor(3*time.Second, func() bool { return q.Size() > 0 })
+		if msgs := q.Pop(); len(msgs) == 1 {
+			return msgs[0]
+		}
+		t.Fatalf("nothing in %v", q.Name())
+		return ""
+	}
+
+	task := UrlTask("http://localhost/retry", map[string]interface{}{"callback": "index"})
+	task.Project = builder.GetName()
+	failed(task)
+
+	retried := core.Task{}
+	_ = json.Unmarshal([]byte(wait(newQ)), &retried)
+	if retried.Schedule.Retried != 1 || !retried.Schedule.Force || retried.Schedule.ExecuteTime < datetime.NowUnix()+50 {
+		t.Fatalf("failed task should be scheduled again later, got %+v", retried.Schedule)
+	}
+
+	failed(&retried)
+	dl := core.DeadLetter{}
+	_ = json.Unmarshal([]byte(wait(deadQ)), &dl)
+	if dl.Reason != core.DeadReasonRetryExhausted || dl.Queue != newQ.Name() || newQ.Size() != 0 {
+		t.Fatalf("task out of retries should be given up, got %+v", dl)
+	}
+}
+
+func TestProcessorDeliversFailures(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []int
+	callback := core.ProcessCallback{
+		Name: "index",
+		Callback: func(task *core.Task, resp *core.Response) ([]*core.Task, *core.Result) {
+			mu.Lock()
+			delivered = append(delivered, resp.StatusCode)
+			mu.Unlock()
+			return nil, nil
+		},
+	}
+	delivering := newProject("retry_callback_test")
+	delivering.AddCallback(callback)
+	delivering.RegisterMe()
+	permanent := newProject("retry_permanent_test")
+	permanent.AddCallback(callback)
+	permanent.(core.IRetryScheduled).SetRetrySchedule(core.RetrySchedule{Delays: []int64{60}})
+	permanent.RegisterMe()
+
+	newQ := NewMemoryQueue("new", 0)
+	f2pQ := NewMemoryQueue("f2p", 0)
+	p := processor.NewProcessor(newQ, f2pQ, NewMemoryQueue("p2r", 0), nil)
+	defer start(p)()
+
+	for _, project := range []string{delivering.GetName(), permanent.GetName()} {
+		status := core.StatusFetchError
+		if project == permanent.GetName() {
+			status = core.StatusTLSError // would fail the same way again
+		}
+		task := UrlTask("http://localhost/failed", map[string]interface{}{"callback": "index"})
+		task.Project = project
+		putFetched(t, f2pQ, task, &core.Response{StatusCode: status, ErrMessage: "failed"})
+	}
+
+	waitFor(3*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 2 || newQ.Size() != 0 {
+		t.Fatalf("failures not retried should reach the callback, delivered %v, retried %d", delivered, newQ.Size())
+	}
+}
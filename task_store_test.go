@@ -0,0 +1,183 @@
+package spider
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/xgo11/spider/components/scheduler"
+	"github.com/xgo11/spider/core"
+)
+
+func TestSchedulerDropsDuplicatedTask(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+	store := NewMemoryTaskStore()
+
+	s := scheduler.NewScheduler(newQ, s2fQ, nil)
+	core.SetTaskStore(s, store)
+	defer start(s)()
+
+	put := func(force bool) {
+		task := UrlTask("http://localhost/detail", nil)
+		task.Project = "task_store_test"
+		task.TaskId = "detail"
+		task.Schedule.Force = force
+		putTask(t, newQ, task)
+	}
+	wait := func(n int) {
+		waitFor(time.Second, func() bool { return s2fQ.Size() >= n })
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	put(false)
+	wait(1)
+	put(false)
+	wait(2)
+	if s2fQ.Size() != 1 {
+		t.Fatalf("duplicated task should be dropped, dispatched %d", s2fQ.Size())
+	}
+
+	put(true)
+	wait(2)
+	if s2fQ.Size() != 2 {
+		t.Fatalf("forced task should be dispatched, dispatched %d", s2fQ.Size())
+	}
+
+	if task, ok := store.Get("task_store_test", "detail"); !ok || task.CreateTime == 0 || task.UpdateTime < task.CreateTime {
+		t.Fatalf("task should be recorded, got %+v", task)
+	}
+}
+
+func TestSchedulerAutoRecrawl(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+	statusQ := NewMemoryQueue("status", 0)
+	store := NewMemoryTaskStore()
+
+	s := scheduler.NewScheduler(newQ, s2fQ, statusQ)
+	core.SetTaskStore(s, store)
+	defer start(s)()
+
+	task := UrlTask("http://localhost/price", nil)
+	task.Project = "task_store_test"
+	task.TaskId = "price"
+	task.Schedule.AutoRecrawl = true
+	task.Schedule.Age = 1
+	putTask(t, newQ, task)
+
+	if !waitFor(6*time.Second, func() bool { return s2fQ.Size() >= 2 }) {
+		t.Fatalf("task should be dispatched again after its age, dispatched %d", s2fQ.Size())
+	}
+	if next := store.DueRecrawl(1<<40, 60, 10); len(next) != 1 || next[0].TaskId != "price" {
+		t.Fatalf("task should stay in the recrawl index, got %v", next)
+	}
+	if next := store.DueRecrawl(1<<40, 60, 10); len(next) != 0 {
+		t.Fatalf("a claimed task should not be due again before its lease ends, got %v", next)
+	}
+}
+
+func TestSchedulerRecrawlKeepsStatus(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+	store := NewMemoryTaskStore()
+
+	// the fetcher reports the crawl before the scheduler is back from dispatching it
+	crawled := func(task *core.Task) {
+		_ = store.Update(task.Project, task.TaskId, func(tsk *core.Task) bool {
+			tsk.Status = core.TaskStatusCrawled
+			return true
+		})
+	}
+	s := scheduler.NewScheduler(newQ, s2fQ, nil, core.SchedulerHook{Hook: core.Hook{Name: "crawled"}, OnTaskSelect: crawled})
+	core.SetTaskStore(s, store)
+	defer start(s)()
+
+	task := UrlTask("http://localhost/stock", nil)
+	task.Project = "task_store_test"
+	task.TaskId = "stock"
+	task.Schedule.AutoRecrawl = true
+	task.Schedule.Age = 1
+	putTask(t, newQ, task)
+
+	if !waitFor(6*time.Second, func() bool { return s2fQ.Size() >= 2 }) {
+		t.Fatalf("task should be dispatched again after its age, dispatched %d", s2fQ.Size())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if tsk, _ := store.Get(task.Project, task.TaskId); tsk.Status != core.TaskStatusCrawled {
+		t.Fatalf("the recrawl should not overwrite the status recorded meanwhile, got %d", tsk.Status)
+	}
+}
+
+func TestSchedulerTracksTaskStatus(t *testing.T) {
+	newQ := NewMemoryQueue("new", 0)
+	s2fQ := NewMemoryQueue("s2f", 0)
+	statusQ := NewMemoryQueue("status", 0)
+	store := NewMemoryTaskStore()
+
+	s := scheduler.NewScheduler(newQ, s2fQ, statusQ)
+	core.SetTaskStore(s, store)
+	defer start(s)()
+
+	task := UrlTask("http://localhost/status", nil)
+	task.Project = "task_store_test"
+	task.TaskId = "status"
+	putTask(t, newQ, task)
+
+	wait := func(status int) *core.Task {
+		var tsk *core.Task
+		reached := waitFor(3*time.Second, func() bool {
+			var ok bool
+			tsk, ok = store.Get(task.Project, task.TaskId)
+			return ok && tsk.Status == status
+		})
+		if !reached {
+			t.Fatalf("task should reach status %d", status)
+		}
+		return tsk
+	}
+	wait(core.TaskStatusScheduled)
+
+	_ = core.SendStatus(statusQ, core.StageResultWorker, task, core.TaskStatusResulted, nil)
+	if tsk := wait(core.TaskStatusResulted); tsk.LastSuccess == 0 || tsk.StatusStage != core.StageResultWorker {
+		t.Fatalf("result should be recorded as success, got %+v", tsk)
+	}
+	_ = core.SendStatus(statusQ, core.StageProcessor, task, core.TaskStatusFailed, errors.New("boom"))
+	if tsk := wait(core.TaskStatusFailed); tsk.LastError != "boom" {
+		t.Fatalf("failure should be recorded, got %+v", tsk)
+	}
+}
+
+func TestTaskStoreUpdateKeepsConcurrentChanges(t *testing.T) {
+	store := NewMemoryTaskStore()
+	task := UrlTask("http://localhost/update", nil)
+	task.Project = "task_store_test"
+	task.TaskId = "update"
+	_ = store.Save(task)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = store.Update(task.Project, task.TaskId, func(tsk *core.Task) bool {
+				tsk.Schedule.Retried++
+				return true
+			})
+		}()
+	}
+	wg.Wait()
+
+	if tsk, _ := store.Get(task.Project, task.TaskId); tsk.Schedule.Retried != 50 {
+		t.Fatalf("every update should be kept, got %d", tsk.Schedule.Retried)
+	}
+	if err := store.Update(task.Project, "unknown", func(*core.Task) bool { return true }); err != nil {
+		t.Fatalf("an unknown task should be ignored, got %v", err)
+	}
+	if _, ok := store.Get(task.Project, "unknown"); ok {
+		t.Fatalf("an unknown task should not be created")
+	}
+}
@@ -0,0 +1,28 @@
+package spider
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+import (
+	"github.com/xgo11/spider/core"
+)
+
+func TestTaskUpdateBody(t *testing.T) {
+	task := UrlTask("http://spider.invalid/", map[string]interface{}{"method": "put", "data": "a=1"})
+	if task.Fetch.Method != "PUT" || task.Fetch.Data != "a=1" {
+		t.Fatalf("method should be kept with a body, got %v %q", task.Fetch.Method, task.Fetch.Data)
+	}
+	task = UrlTask("http://spider.invalid/", map[string]interface{}{"json": map[string]int{"a": 1}})
+	if task.Fetch.Method != "POST" || string(task.Fetch.Json) != `{"a":1}` {
+		t.Fatalf("json should be a POST body, got %v %s", task.Fetch.Method, task.Fetch.Json)
+	}
+	task = UrlTask("http://spider.invalid/", map[string]interface{}{"binary_data": []byte{0, 1, 2}})
+	out, _ := json.Marshal(task)
+	decoded := core.Task{}
+	_ = json.Unmarshal(out, &decoded)
+	if decoded.Fetch.Method != "POST" || string(decoded.Fetch.BinaryData) != "\x00\x01\x02" {
+		t.Fatalf("binary data should survive json, got %v %v", decoded.Fetch.Method, decoded.Fetch.BinaryData)
+	}
+}